@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/montanaflynn/stats"
+)
+
+// BacklogBenchmark measures how the broker queues messages for offline subscribers: the subscribers register a
+// persistent session and go offline, a backlog is published, then the subscribers reconnect and drain their queue
+type BacklogBenchmark struct {
+	BrokerURL   string
+	BrokerUser  string
+	BrokerPass  string
+	TLSConfig   *tls.Config
+	Topic       string
+	Backlog     int
+	Subscribers int
+	MsgSize     int
+	MsgQoS      byte
+	Timeout     time.Duration // idle time after which a subscriber stops waiting for queued messages
+	WaitTimeout time.Duration
+	Quiet       bool
+}
+
+// BacklogResults describes results of an offline queue benchmark
+type BacklogResults struct {
+	Backlog           int     `json:"backlog"`
+	Subscribers       int     `json:"subscribers"`
+	PublishTime       float64 `json:"publish_time"`
+	PublishMsgsPerSec float64 `json:"publish_msgs_per_sec"`
+	SessionPresent    int     `json:"session_present"`
+	Expected          int64   `json:"expected"`
+	Received          int64   `json:"received"`
+	Missing           int64   `json:"missing"`
+	Duplicates        int64   `json:"duplicates"`
+	FirstMsgTimeAvg   float64 `json:"first_msg_time_mean_avg"`
+	DrainTimeMin      float64 `json:"drain_time_min"`
+	DrainTimeMax      float64 `json:"drain_time_max"`
+	DrainTimeAvg      float64 `json:"drain_time_mean_avg"`
+	AvgMsgsPerSec     float64 `json:"avg_msgs_per_sec"`
+	TotalMsgsPerSec   float64 `json:"total_msgs_per_sec"`
+	QueueTimeMin      float64 `json:"queue_time_min"`
+	QueueTimeMax      float64 `json:"queue_time_max"`
+	QueueTimeAvg      float64 `json:"queue_time_mean_avg"`
+	QueueTimeP50      float64 `json:"queue_time_p50"`
+	QueueTimeP99      float64 `json:"queue_time_p99"`
+}
+
+type backlogSubResults struct {
+	sessionPresent bool
+	received       int64
+	duplicates     int64
+	firstMsg       time.Duration
+	drain          time.Duration
+	latencies      []float64
+}
+
+// Run registers the sessions, publishes the backlog, drains it and finally discards the sessions
+func (b *BacklogBenchmark) Run() *BacklogResults {
+	res := &BacklogResults{Backlog: b.Backlog, Subscribers: b.Subscribers}
+	runStamp := time.Now().UTC().UnixMilli()
+	clientIDs := make([]string, b.Subscribers)
+	for i := range clientIDs {
+		clientIDs[i] = fmt.Sprintf("subscriber-backlog-%v-%v", i, runStamp)
+		b.register(clientIDs[i])
+	}
+
+	pubResCh := make(chan *RunResults)
+	pub := &PublisherClient{
+		ID:          "backlog",
+		ClientID:    fmt.Sprintf("publisher-backlog-%v", runStamp),
+		BrokerURL:   b.BrokerURL,
+		BrokerUser:  b.BrokerUser,
+		BrokerPass:  b.BrokerPass,
+		MsgTopic:    b.Topic,
+		MsgSize:     b.MsgSize,
+		MsgCount:    b.Backlog,
+		MsgQoS:      b.MsgQoS,
+		Quiet:       b.Quiet,
+		WaitTimeout: b.WaitTimeout,
+		TLSConfig:   b.TLSConfig,
+		Disconnect:  true,
+	}
+	if !b.Quiet {
+		log.Printf("Publishing a backlog of %v messages for %v offline subscribers\n", b.Backlog, b.Subscribers)
+	}
+	started := time.Now()
+	go pub.Run(pubResCh)
+	pubRes := <-pubResCh
+	res.PublishTime = time.Since(started).Seconds()
+	res.PublishMsgsPerSec = float64(pubRes.Successes) / res.PublishTime
+	if pubRes.ConnectError != "" {
+		log.Fatalf("Error publishing the backlog: %v", pubRes.ConnectError)
+	}
+
+	var wg sync.WaitGroup
+	subResults := make([]*backlogSubResults, b.Subscribers)
+	for i, clientID := range clientIDs {
+		wg.Add(1)
+		go func(i int, clientID string) {
+			defer wg.Done()
+			subResults[i] = b.drain(clientID)
+		}(i, clientID)
+	}
+	wg.Wait()
+
+	latencies := []float64{}
+	drains := []float64{}
+	firstMsgs := []float64{}
+	for _, sub := range subResults {
+		if sub.sessionPresent {
+			res.SessionPresent++
+		}
+		res.Expected += int64(b.Backlog)
+		res.Received += sub.received
+		res.Duplicates += sub.duplicates
+		latencies = append(latencies, sub.latencies...)
+		if sub.received > 0 {
+			firstMsgs = append(firstMsgs, float64(sub.firstMsg.Microseconds())/1000)
+			drains = append(drains, sub.drain.Seconds())
+			res.TotalMsgsPerSec += float64(sub.received) / sub.drain.Seconds()
+		}
+	}
+	res.Missing = res.Expected - res.Received
+	if b.Subscribers > 0 {
+		res.AvgMsgsPerSec = res.TotalMsgsPerSec / float64(b.Subscribers)
+	}
+	if len(drains) > 0 {
+		res.FirstMsgTimeAvg, _ = stats.Mean(firstMsgs)
+		res.DrainTimeMin, _ = stats.Min(drains)
+		res.DrainTimeMax, _ = stats.Max(drains)
+		res.DrainTimeAvg, _ = stats.Mean(drains)
+	}
+	if len(latencies) > 0 {
+		res.QueueTimeMin, _ = stats.Min(latencies)
+		res.QueueTimeMax, _ = stats.Max(latencies)
+		res.QueueTimeAvg, _ = stats.Mean(latencies)
+		res.QueueTimeP50, _ = stats.Percentile(latencies, 50)
+		res.QueueTimeP99, _ = stats.Percentile(latencies, 99)
+	}
+
+	for _, clientID := range clientIDs {
+		b.discard(clientID)
+	}
+	return res
+}
+
+// register subscribes with a persistent session and disconnects, leaving the broker to queue the messages
+func (b *BacklogBenchmark) register(clientID string) {
+	client := b.newClient(clientID, false, nil)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("SUBSCRIBER %v had error connecting to the broker: %v", clientID, token.Error())
+	}
+	if token := client.Subscribe(b.Topic, b.MsgQoS, nil); token.Wait() && token.Error() != nil {
+		log.Fatalf("SUBSCRIBER %v had error subscribing to %v: %v", clientID, b.Topic, token.Error())
+	}
+	client.Disconnect(250)
+}
+
+// drain reconnects to the persistent session without subscribing again and receives the queued messages
+func (b *BacklogBenchmark) drain(clientID string) *backlogSubResults {
+	res := &backlogSubResults{}
+	msgChan := make(chan mqtt.Message)
+	done := make(chan struct{})
+	defer close(done)
+
+	client := b.newClient(clientID, false, func(c mqtt.Client, m mqtt.Message) {
+		select {
+		case msgChan <- m:
+		case <-done:
+		}
+	})
+	started := time.Now()
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		log.Printf("SUBSCRIBER %v had error reconnecting to the broker: %v\n", clientID, token.Error())
+		return res
+	}
+	defer client.Disconnect(250)
+	if ct, ok := token.(*mqtt.ConnectToken); ok {
+		res.sessionPresent = ct.SessionPresent()
+	}
+
+	seen := make(map[uint64]struct{}, b.Backlog)
+	timer := time.NewTimer(b.Timeout)
+	defer timer.Stop()
+	for res.received < int64(b.Backlog) {
+		select {
+		case m := <-msgChan:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(b.Timeout)
+			if header, ok := readHeader(m.Payload()); ok {
+				if _, dup := seen[header.key()]; dup {
+					res.duplicates++
+					continue
+				}
+				seen[header.key()] = struct{}{}
+				res.latencies = append(res.latencies, float64(uint64(time.Now().UTC().UnixMilli())-header.Sent))
+			}
+			if res.received == 0 {
+				res.firstMsg = time.Since(started)
+			}
+			res.received++
+			res.drain = time.Since(started)
+		case <-timer.C:
+			if !b.Quiet {
+				log.Printf("SUBSCRIBER %v only drained %v of %v queued messages\n", clientID, res.received, b.Backlog)
+			}
+			return res
+		}
+	}
+	return res
+}
+
+// discard removes the persistent session by connecting once with a clean session
+func (b *BacklogBenchmark) discard(clientID string) {
+	client := b.newClient(clientID, true, nil)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("SUBSCRIBER %v had error discarding its session: %v\n", clientID, token.Error())
+		return
+	}
+	client.Disconnect(250)
+}
+
+func (b *BacklogBenchmark) newClient(clientID string, cleanSession bool, onMessage mqtt.MessageHandler) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(clientID).
+		SetCleanSession(cleanSession).
+		SetAutoReconnect(false).
+		SetDefaultPublishHandler(onMessage)
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	opts.SetKeepAlive(0)
+	return mqtt.NewClient(opts)
+}
+
+func printBacklogResults(res *BacklogResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= BACKLOG (%d messages) =========\n", res.Backlog)
+		fmt.Printf("Publish time (sec):          %.3f\n", res.PublishTime)
+		fmt.Printf("Publish rate (msg/sec):      %.3f\n", res.PublishMsgsPerSec)
+		fmt.Printf("Session present:             %d/%d\n", res.SessionPresent, res.Subscribers)
+		fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(res.Received)/float64(res.Expected), res.Received, res.Expected)
+		fmt.Printf("Missing messages:            %d\n", res.Missing)
+		fmt.Printf("Duplicated messages:         %d\n", res.Duplicates)
+		fmt.Printf("First message time (ms):     %.3f\n", res.FirstMsgTimeAvg)
+		fmt.Printf("Drain time min (sec):        %.3f\n", res.DrainTimeMin)
+		fmt.Printf("Drain time max (sec):        %.3f\n", res.DrainTimeMax)
+		fmt.Printf("Drain time mean (sec):       %.3f\n", res.DrainTimeAvg)
+		fmt.Printf("Average Drain Rate Per Subscriber (msg/sec): %.3f\n", res.AvgMsgsPerSec)
+		fmt.Printf("Total Drain Rate Subscribers (msg/sec):   %.3f\n", res.TotalMsgsPerSec)
+		fmt.Printf("Queue time min (ms):         %.3f\n", res.QueueTimeMin)
+		fmt.Printf("Queue time max (ms):         %.3f\n", res.QueueTimeMax)
+		fmt.Printf("Queue time mean (ms):        %.3f\n", res.QueueTimeAvg)
+		fmt.Printf("Queue time p50 (ms):         %.3f\n", res.QueueTimeP50)
+		fmt.Printf("Queue time p99 (ms):         %.3f\n", res.QueueTimeP99)
+	}
+}
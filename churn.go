@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+// ChurnGenerator cycles short lived publishers through connect, publish and disconnect at a target rate
+type ChurnGenerator struct {
+	Rate     int // clients started per second
+	Duration time.Duration
+	Quiet    bool
+	// NewPublisher returns the publisher of the given cycle
+	NewPublisher func(cycle int) *PublisherClient
+}
+
+// ChurnResults describes results of a churn workload
+type ChurnResults struct {
+	Cycles          int64            `json:"cycles"`
+	ClientsPerSec   float64          `json:"clients_per_sec"`
+	ConnectFailures int64            `json:"connect_failures"`
+	FailureReasons  map[string]int64 `json:"failure_reasons"`
+	SessionsResumed int64            `json:"sessions_resumed"`
+	ConnectTimeMin  float64          `json:"connect_time_min"`
+	ConnectTimeMax  float64          `json:"connect_time_max"`
+	ConnectTimeAvg  float64          `json:"connect_time_mean_avg"`
+	ConnectTimeP99  float64          `json:"connect_time_p99"`
+	Published       int64            `json:"published"`
+	Received        int64            `json:"received"`
+	DeliveryRatio   float64          `json:"delivery_ratio"`
+	MsgTimeMin      float64          `json:"msg_time_min"`
+	MsgTimeMax      float64          `json:"msg_time_max"`
+	MsgTimeAvg      float64          `json:"msg_time_mean_avg"`
+	RunTime         float64          `json:"run_time"`
+	PublishedBytes  int64            `json:"published_bytes"`
+	ReceivedBytes   int64            `json:"received_bytes"`
+	MBPerSecPub     float64          `json:"mb_per_sec_pub"`
+	MBPerSecSub     float64          `json:"mb_per_sec_sub"`
+}
+
+// Cycles returns the number of clients the generator starts
+func (g *ChurnGenerator) Cycles() int {
+	return int(g.Duration.Seconds() * float64(g.Rate))
+}
+
+// Run starts the publishers and collects their results once they are all done
+func (g *ChurnGenerator) Run() []*RunResults {
+	cycles := g.Cycles()
+	resCh := make(chan *RunResults)
+	ticker := time.NewTicker(time.Second / time.Duration(g.Rate))
+	defer ticker.Stop()
+
+	go func() {
+		for i := 0; i < cycles; i++ {
+			<-ticker.C
+			go g.NewPublisher(i).Run(resCh)
+			if !g.Quiet && i > 0 && i%100 == 0 {
+				log.Printf("Started %v churn clients and keeps churning...\n", i)
+			}
+		}
+	}()
+
+	results := make([]*RunResults, cycles)
+	for i := 0; i < cycles; i++ {
+		results[i] = <-resCh
+	}
+	return results
+}
+
+func calculateChurnResults(results []*RunResults, sub *SubscriberResults, latencies []uint64, runTime time.Duration) *ChurnResults {
+	res := &ChurnResults{
+		Cycles:         int64(len(results)),
+		FailureReasons: make(map[string]int64),
+		Received:       sub.Received,
+		ReceivedBytes:  sub.Bytes,
+		RunTime:        runTime.Seconds(),
+	}
+	res.ClientsPerSec = float64(res.Cycles) / runTime.Seconds()
+	res.MBPerSecSub = float64(res.ReceivedBytes) / runTime.Seconds() / 1e6
+
+	connectTimes := []float64{}
+	for _, r := range results {
+		if r.ConnectError != "" {
+			res.ConnectFailures++
+			res.FailureReasons[r.ConnectError]++
+			continue
+		}
+		if r.SessionPresent {
+			res.SessionsResumed++
+		}
+		res.Published += r.Successes
+		res.PublishedBytes += r.Bytes
+		connectTimes = append(connectTimes, r.ConnectTime)
+	}
+	if len(connectTimes) > 0 {
+		res.ConnectTimeMin, _ = stats.Min(connectTimes)
+		res.ConnectTimeMax, _ = stats.Max(connectTimes)
+		res.ConnectTimeAvg, _ = stats.Mean(connectTimes)
+		res.ConnectTimeP99, _ = stats.Percentile(connectTimes, 99)
+	}
+	res.MBPerSecPub = float64(res.PublishedBytes) / runTime.Seconds() / 1e6
+	if res.Published > 0 {
+		res.DeliveryRatio = float64(res.Received) / float64(res.Published)
+	}
+	if len(latencies) > 0 {
+		latenciesFloat64 := stats.LoadRawData(latencies)
+		res.MsgTimeMin, _ = stats.Min(latenciesFloat64)
+		res.MsgTimeMax, _ = stats.Max(latenciesFloat64)
+		res.MsgTimeAvg, _ = stats.Mean(latenciesFloat64)
+	}
+	return res
+}
+
+func printChurnResults(res *ChurnResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= CHURN (%d) =========\n", res.Cycles)
+		fmt.Printf("Runtime (sec):               %.3f\n", res.RunTime)
+		fmt.Printf("Churn rate (clients/sec):    %.3f\n", res.ClientsPerSec)
+		fmt.Printf("Connect failures:            %d\n", res.ConnectFailures)
+		fmt.Printf("Sessions resumed:            %d\n", res.SessionsResumed)
+		fmt.Printf("Connect time min (ms):       %.3f\n", res.ConnectTimeMin)
+		fmt.Printf("Connect time max (ms):       %.3f\n", res.ConnectTimeMax)
+		fmt.Printf("Connect time mean (ms):      %.3f\n", res.ConnectTimeAvg)
+		fmt.Printf("Connect time p99 (ms):       %.3f\n", res.ConnectTimeP99)
+		fmt.Printf("Delivery ratio:              %.3f (%d/%d)\n", res.DeliveryRatio, res.Received, res.Published)
+		fmt.Printf("Msg time min (ms):           %.3f\n", res.MsgTimeMin)
+		fmt.Printf("Msg time max (ms):           %.3f\n", res.MsgTimeMax)
+		fmt.Printf("Msg time mean (ms):          %.3f\n", res.MsgTimeAvg)
+		fmt.Printf("Published (MB/sec):          %.3f (%d bytes)\n", res.MBPerSecPub, res.PublishedBytes)
+		fmt.Printf("Received (MB/sec):           %.3f (%d bytes)\n", res.MBPerSecSub, res.ReceivedBytes)
+		printFailureReasons(res.FailureReasons)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/montanaflynn/stats"
+)
+
+// ConnectBenchmark opens many clients at a target rate and measures how fast the broker accepts them
+type ConnectBenchmark struct {
+	BrokerURL      string
+	BrokerUser     string
+	BrokerPass     string
+	TLSConfig      *tls.Config
+	Connections    int
+	Rate           int // connections per second, 0 opens them as fast as possible
+	ConnectTimeout time.Duration
+	Hold           time.Duration
+	Quiet          bool
+	Monitor        *ResourceMonitor
+}
+
+// ConnectResults describes results of a connection benchmark
+type ConnectResults struct {
+	Attempts         int64            `json:"attempts"`
+	Successes        int64            `json:"successes"`
+	Failures         int64            `json:"failures"`
+	FailureReasons   map[string]int64 `json:"failure_reasons"`
+	RunTime          float64          `json:"run_time"`
+	ConnectsPerSec   float64          `json:"connects_per_sec"`
+	ConnackTimeMin   float64          `json:"connack_time_min"`
+	ConnackTimeMax   float64          `json:"connack_time_max"`
+	ConnackTimeAvg   float64          `json:"connack_time_mean_avg"`
+	ConnackTimeStd   float64          `json:"connack_time_mean_std"`
+	ConnackTimeP50   float64          `json:"connack_time_p50"`
+	ConnackTimeP95   float64          `json:"connack_time_p95"`
+	ConnackTimeP99   float64          `json:"connack_time_p99"`
+	AvgCpuUsage      float64          `json:"avg_cpu_usage"`
+	AvgMemoryUsage   float64          `json:"avg_memory_usage"`
+	MemoryPerConnKiB float64          `json:"memory_per_connection_kib,omitempty"`
+}
+
+// Run opens every connection, optionally holds them idle, and returns the results
+func (b *ConnectBenchmark) Run() *ConnectResults {
+	res := &ConnectResults{FailureReasons: make(map[string]int64)}
+	memBefore := b.Monitor.MemoryUsed()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	latencies := []float64{}
+	clients := []mqtt.Client{}
+
+	connect := func(i int) {
+		defer wg.Done()
+		opts := mqtt.NewClientOptions().
+			AddBroker(b.BrokerURL).
+			SetClientID(fmt.Sprintf("connect-%v-%v", i, time.Now().UTC().UnixMilli())).
+			SetCleanSession(true).
+			SetAutoReconnect(false).
+			SetConnectTimeout(b.ConnectTimeout)
+		if b.BrokerUser != "" && b.BrokerPass != "" {
+			opts.SetUsername(b.BrokerUser)
+			opts.SetPassword(b.BrokerPass)
+		}
+		if b.TLSConfig != nil {
+			opts.SetTLSConfig(b.TLSConfig)
+		}
+		opts.SetKeepAlive(0)
+
+		client := mqtt.NewClient(opts)
+		started := time.Now()
+		token := client.Connect()
+		token.Wait()
+		elapsed := float64(time.Since(started).Microseconds()) / 1000
+
+		mu.Lock()
+		defer mu.Unlock()
+		if token.Error() != nil {
+			res.Failures++
+			res.FailureReasons[token.Error().Error()]++
+			return
+		}
+		res.Successes++
+		latencies = append(latencies, elapsed)
+		clients = append(clients, client)
+	}
+
+	b.Monitor.Start(time.Second)
+	started := time.Now()
+	var ticker *time.Ticker
+	if b.Rate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(b.Rate))
+		defer ticker.Stop()
+	}
+	for i := 0; i < b.Connections; i++ {
+		if ticker != nil {
+			<-ticker.C
+		}
+		wg.Add(1)
+		go connect(i)
+		if !b.Quiet && i > 0 && i%1000 == 0 {
+			log.Printf("Opened %v connections and keeps connecting...\n", i)
+		}
+	}
+	wg.Wait()
+	duration := time.Since(started)
+
+	res.Attempts = int64(b.Connections)
+	res.RunTime = duration.Seconds()
+	res.ConnectsPerSec = float64(res.Successes) / duration.Seconds()
+	if len(latencies) > 0 {
+		res.ConnackTimeMin, _ = stats.Min(latencies)
+		res.ConnackTimeMax, _ = stats.Max(latencies)
+		res.ConnackTimeAvg, _ = stats.Mean(latencies)
+		res.ConnackTimeStd, _ = stats.StandardDeviationSample(latencies)
+		res.ConnackTimeP50, _ = stats.Percentile(latencies, 50)
+		res.ConnackTimeP95, _ = stats.Percentile(latencies, 95)
+		res.ConnackTimeP99, _ = stats.Percentile(latencies, 99)
+	}
+
+	if b.Hold > 0 && res.Successes > 0 {
+		if !b.Quiet {
+			log.Printf("Holding %v idle connections for %v\n", res.Successes, b.Hold)
+		}
+		time.Sleep(b.Hold)
+		memHeld := b.Monitor.MemoryUsed()
+		if memHeld > memBefore {
+			res.MemoryPerConnKiB = float64(memHeld-memBefore) / 1024 / float64(res.Successes)
+		}
+	}
+	res.AvgCpuUsage, res.AvgMemoryUsage = b.Monitor.Stop()
+
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client mqtt.Client) {
+			defer wg.Done()
+			client.Disconnect(250)
+		}(client)
+	}
+	wg.Wait()
+
+	return res
+}
+
+func printConnectResults(res *ConnectResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= CONNECTIONS (%d) =========\n", res.Attempts)
+		fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(res.Successes)/float64(res.Attempts), res.Successes, res.Attempts)
+		fmt.Printf("Runtime (sec):               %.3f\n", res.RunTime)
+		fmt.Printf("Connect rate (conn/sec):     %.3f\n", res.ConnectsPerSec)
+		fmt.Printf("CONNACK time min (ms):       %.3f\n", res.ConnackTimeMin)
+		fmt.Printf("CONNACK time max (ms):       %.3f\n", res.ConnackTimeMax)
+		fmt.Printf("CONNACK time mean (ms):      %.3f\n", res.ConnackTimeAvg)
+		fmt.Printf("CONNACK time std (ms):       %.3f\n", res.ConnackTimeStd)
+		fmt.Printf("CONNACK time p50 (ms):       %.3f\n", res.ConnackTimeP50)
+		fmt.Printf("CONNACK time p95 (ms):       %.3f\n", res.ConnackTimeP95)
+		fmt.Printf("CONNACK time p99 (ms):       %.3f\n", res.ConnackTimeP99)
+		fmt.Printf("Average CPU Usage (percent): %.2f\n", res.AvgCpuUsage)
+		fmt.Printf("Average RAM Usage (percent): %.2f\n", res.AvgMemoryUsage)
+		if res.MemoryPerConnKiB > 0 {
+			fmt.Printf("Memory per connection (KiB): %.3f\n", res.MemoryPerConnKiB)
+		}
+		printFailureReasons(res.FailureReasons)
+	}
+}
+
+func printFailureReasons(reasons map[string]int64) {
+	if len(reasons) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		keys = append(keys, reason)
+	}
+	sort.Strings(keys)
+	fmt.Printf("Failures:\n")
+	for _, reason := range keys {
+		fmt.Printf("  %6d  %v\n", reasons[reason], reason)
+	}
+}
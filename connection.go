@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// errConnDropped is returned by reads on a connection dropped by the benchmark. paho ignores the
+// "use of closed network connection" error of a plain Close, which would hide the connection loss
+var errConnDropped = errors.New("connection dropped by benchmark")
+
+// ConnTracker holds the network connection of a client so it can be dropped on demand.
+// When OnPacket is set, it is called with the type of every MQTT packet sent or received
+type ConnTracker struct {
+	OnPacket func(outbound bool, packetType byte)
+
+	mu   sync.Mutex
+	conn *trackedConn
+}
+
+// trackedConn reports errConnDropped instead of the closed connection error once dropped
+type trackedConn struct {
+	net.Conn
+	dropped int32
+	in      *packetScanner
+	out     *packetScanner
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.in != nil && n > 0 {
+		c.in.scan(b[:n])
+	}
+	if err != nil && atomic.LoadInt32(&c.dropped) == 1 {
+		err = errConnDropped
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.out != nil && n > 0 {
+		c.out.scan(b[:n])
+	}
+	if err != nil && atomic.LoadInt32(&c.dropped) == 1 {
+		err = errConnDropped
+	}
+	return n, err
+}
+
+func (c *trackedConn) drop() {
+	atomic.StoreInt32(&c.dropped, 1)
+	_ = c.Conn.Close()
+}
+
+// packetScanner follows the MQTT framing of a byte stream and reports the type of every packet as it starts
+type packetScanner struct {
+	mu         sync.Mutex
+	state      int
+	remaining  int
+	multiplier int
+	onPacket   func(packetType byte)
+}
+
+const (
+	scanType = iota
+	scanLength
+	scanBody
+	scanInvalid // the remaining length took more than 4 bytes, the framing is lost
+)
+
+// maxLengthMultiplier is the multiplier of the fourth and last byte of a remaining length
+const maxLengthMultiplier = 128 * 128 * 128
+
+func (s *packetScanner) scan(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < len(b); i++ {
+		switch s.state {
+		case scanType:
+			s.onPacket(b[i] >> 4)
+			s.remaining = 0
+			s.multiplier = 1
+			s.state = scanLength
+		case scanLength:
+			s.remaining += int(b[i]&127) * s.multiplier
+			if b[i]&128 != 0 && s.multiplier == maxLengthMultiplier {
+				s.state = scanInvalid
+				return
+			}
+			s.multiplier *= 128
+			if b[i]&128 == 0 {
+				s.state = scanBody
+				if s.remaining == 0 {
+					s.state = scanType
+				}
+			}
+		case scanBody:
+			skip := len(b) - i
+			if skip > s.remaining {
+				skip = s.remaining
+			}
+			i += skip - 1
+			s.remaining -= skip
+			if s.remaining == 0 {
+				s.state = scanType
+			}
+		case scanInvalid:
+			return
+		}
+	}
+}
+
+// publishWireSize estimates the bytes a message takes on the network: the PUBLISH packet with its fixed and variable
+// headers, and the packets acknowledging it (PUBACK for QoS 1, PUBREC, PUBREL and PUBCOMP for QoS 2)
+func publishWireSize(topic string, qos byte, payloadLen int) int64 {
+	remaining := 2 + len(topic) + payloadLen
+	if qos > 0 {
+		remaining += 2 // packet identifier
+	}
+	lengthBytes := 1
+	for n := remaining; n >= 128; n /= 128 {
+		lengthBytes++
+	}
+	size := 1 + lengthBytes + remaining
+	switch qos {
+	case 1:
+		size += 4
+	case 2:
+		size += 3 * 4
+	}
+	return int64(size)
+}
+
+// openConnection dials the broker the same way paho does and keeps a handle on the connection
+func (t *ConnTracker) openConnection(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	dialer := options.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 30 * time.Second}
+	}
+
+	var conn net.Conn
+	var err error
+	switch uri.Scheme {
+	case "ws", "wss":
+		dialURI := *uri
+		dialURI.User = nil
+		var tlsConfig *tls.Config
+		if uri.Scheme == "wss" {
+			tlsConfig = options.TLSConfig
+		}
+		conn, err = mqtt.NewWebsocket(dialURI.String(), tlsConfig, options.ConnectTimeout, options.HTTPHeaders, options.WebsocketOptions)
+	case "mqtt", "tcp":
+		conn, err = dialer.Dial("tcp", uri.Host)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", uri.Host, options.TLSConfig)
+	default:
+		err = errors.New("unknown protocol")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dc := &trackedConn{Conn: conn}
+	if t.OnPacket != nil {
+		dc.in = &packetScanner{onPacket: func(packetType byte) { t.OnPacket(false, packetType) }}
+		dc.out = &packetScanner{onPacket: func(packetType byte) { t.OnPacket(true, packetType) }}
+	}
+	t.mu.Lock()
+	t.conn = dc
+	t.mu.Unlock()
+	return dc, nil
+}
+
+// Drop closes the current network connection without sending DISCONNECT, as a crashed client or a network failure would
+func (t *ConnTracker) Drop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return false
+	}
+	t.conn.drop()
+	t.conn = nil
+	return true
+}
+
+// parseDropTimes parses a comma separated list of durations, e.g. "10s,45s"
+func parseDropTimes(value string) ([]time.Duration, error) {
+	var times []time.Duration
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, d)
+	}
+	return times, nil
+}
+
+// dropConnections drops the connection of every tracked client at each of the given offsets from start
+func dropConnections(start time.Time, times []time.Duration, trackers []*ConnTracker, quiet bool) {
+	for _, offset := range times {
+		time.Sleep(time.Until(start.Add(offset)))
+		dropped := 0
+		for _, t := range trackers {
+			if t.Drop() {
+				dropped++
+			}
+		}
+		if !quiet {
+			log.Printf("Dropped %v connections at %v\n", dropped, offset)
+		}
+	}
+}
+
+// reconnectStats records how long a client took to recover from each lost connection
+type reconnectStats struct {
+	mu     sync.Mutex
+	lostAt time.Time
+	times  []float64
+}
+
+func (s *reconnectStats) lost() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lostAt = time.Now()
+}
+
+func (s *reconnectStats) connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lostAt.IsZero() {
+		s.times = append(s.times, float64(time.Since(s.lostAt).Microseconds())/1000)
+		s.lostAt = time.Time{}
+	}
+}
+
+// snapshot returns the reconnect times in milliseconds
+func (s *reconnectStats) snapshot() []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]float64{}, s.times...)
+}
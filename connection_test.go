@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// packet frames an MQTT packet of the given type with a body of n bytes
+func packet(packetType byte, n int) []byte {
+	b := []byte{packetType << 4}
+	for x := n; ; x /= 128 {
+		if x >= 128 {
+			b = append(b, byte(x%128)|128)
+			continue
+		}
+		b = append(b, byte(x))
+		break
+	}
+	return append(b, bytes.Repeat([]byte{0xaa}, n)...)
+}
+
+func TestPacketScanner(t *testing.T) {
+	stream := [][]byte{packet(1, 12), packet(12, 0), packet(3, 200), packet(4, 2), packet(3, 20000), packet(13, 0)}
+	expected := []byte{1, 12, 3, 4, 3, 13}
+	data := bytes.Join(stream, nil)
+	// the stream may be split anywhere by the network reads
+	for _, chunk := range []int{1, 2, 3, 7, 128, len(data)} {
+		types := []byte{}
+		s := &packetScanner{onPacket: func(packetType byte) { types = append(types, packetType) }}
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			if end > len(data) {
+				end = len(data)
+			}
+			s.scan(data[i:end])
+		}
+		if !reflect.DeepEqual(types, expected) {
+			t.Errorf("chunks of %v bytes: scanned %v, expected %v", chunk, types, expected)
+		}
+	}
+}
+
+func TestPacketScannerMalformed(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data     []byte
+		expected []byte
+	}{
+		// a fifth length byte is invalid, the rest of the stream cannot be framed
+		"length too long":  {append(append([]byte{0x30}, bytes.Repeat([]byte{0xff}, 12)...), packet(12, 0)...), []byte{3}},
+		"truncated body":   {packet(3, 10)[:5], []byte{3}},
+		"truncated length": {[]byte{0x30, 0x80}, []byte{3}},
+	} {
+		types := []byte{}
+		s := &packetScanner{onPacket: func(packetType byte) { types = append(types, packetType) }}
+		s.scan(tc.data)
+		if !reflect.DeepEqual(types, tc.expected) {
+			t.Errorf("%v: scanned %v, expected %v", name, types, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montanaflynn/stats"
+)
+
+// DeviceProfile describes a kind of device of the simulated fleet. In topics and payload templates, {device} is
+// replaced by the device id, e.g. thermostat-12, the device targeted by a command payload, and must be a whole topic
+// level:
+//
+//	{
+//	  "thermostat": {
+//	    "topics": ["home/{device}/temperature"],
+//	    "interval_ms": 30000,
+//	    "payload": "{\"device\":\"{device}\",\"temp\":{{randFloat 18 24}}}",
+//	    "qos": 1,
+//	    "commands": "home/{device}/set",
+//	    "command_interval_ms": 300000
+//	  }
+//	}
+//
+// A device publishes -count messages on its topics in turn, every interval. A backend subscriber per topic, where
+// {device} becomes the + wildcard, consumes the telemetry of all the devices and, for profiles with a command topic, a
+// backend publisher sends every device a command every command interval while the telemetry runs
+type DeviceProfile struct {
+	Name            string   `json:"-"`
+	Topics          []string `json:"topics"`
+	Interval        int      `json:"interval_ms"` // defaults to -message-interval
+	Payload         string   `json:"payload"`     // payload template, empty sends Size bytes
+	Size            int      `json:"size"`        // payload size when there is no template, defaults to -size
+	QoS             *int     `json:"qos"`         // defaults to -qos
+	Commands        string   `json:"commands"`    // command topic subscribed by the device, empty for none
+	CommandInterval int      `json:"command_interval_ms"`
+	CommandPayload  string   `json:"command_payload"` // command payload template, empty sends commandSize bytes
+}
+
+// commandSize is the size of the commands without payload template
+const commandSize = 64
+
+// builtinDeviceProfiles are available without profiles file, which can override them
+var builtinDeviceProfiles = map[string]*DeviceProfile{
+	"thermostat": {
+		Topics:          []string{"home/{device}/temperature"},
+		Interval:        30000,
+		Payload:         `{"device":"{device}","temp":{{randFloat 18 24}},"setpoint":{{randInt 18 22}},"mode":"{{pick "heat" "cool" "off"}}"}`,
+		Commands:        "home/{device}/set",
+		CommandInterval: 300000,
+		CommandPayload:  `{"setpoint":{{randInt 18 22}}}`,
+	},
+	"gateway": {
+		Topics:          []string{"site/{device}/telemetry", "site/{device}/status"},
+		Interval:        1000,
+		Size:            2048,
+		Commands:        "site/{device}/config",
+		CommandInterval: 60000,
+	},
+	"tracker": {
+		Topics:   []string{"fleet/{device}/location"},
+		Interval: 10000,
+		Payload:  `{"device":"{device}","lat":{{randFloat 45 46}},"lon":{{randFloat -74 -73}},"speed":{{randInt 0 120}},"battery":{{randInt 5 100}}}`,
+		QoS:      new(int),
+	},
+}
+
+// loadDeviceProfiles returns the built-in profiles, overridden and extended by the profiles of the file if any
+func loadDeviceProfiles(path string) (map[string]*DeviceProfile, error) {
+	profiles := map[string]*DeviceProfile{}
+	for name, p := range builtinDeviceProfiles {
+		profiles[name] = p
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		loaded := map[string]*DeviceProfile{}
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return nil, fmt.Errorf("invalid device profiles %v: %v", path, err)
+		}
+		for name, p := range loaded {
+			profiles[name] = p
+		}
+	}
+	for name, p := range profiles {
+		p.Name = name
+	}
+	return profiles, nil
+}
+
+// check validates the profile, the templates are rendered once for the device given
+func (p *DeviceProfile) check(device string) error {
+	if len(p.Topics) == 0 {
+		return fmt.Errorf("profile %v has no topic", p.Name)
+	}
+	for _, topic := range append([]string{p.Commands}, p.Topics...) {
+		if topic == "" {
+			continue
+		}
+		if strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("profile %v: topic %v should not contain wildcards", p.Name, topic)
+		}
+		for _, level := range strings.Split(topic, "/") {
+			if level != "{device}" && strings.Contains(level, "{device}") {
+				return fmt.Errorf("profile %v: {device} should be a whole level of topic %v", p.Name, topic)
+			}
+		}
+	}
+	if p.Interval < 0 || p.CommandInterval < 0 || p.Size < 0 {
+		return fmt.Errorf("profile %v: intervals and size should be >= 0", p.Name)
+	}
+	if p.QoS != nil && (*p.QoS < 0 || *p.QoS > 2) {
+		return fmt.Errorf("profile %v: qos should be 0, 1 or 2, given: %v", p.Name, *p.QoS)
+	}
+	if p.Size != 0 && p.Size < headerLen {
+		return fmt.Errorf("profile %v: size should be >= %v, given: %v", p.Name, headerLen, p.Size)
+	}
+	if p.Commands != "" && p.CommandInterval == 0 {
+		return fmt.Errorf("profile %v: commands need a command interval", p.Name)
+	}
+	for _, text := range []string{p.Payload, p.CommandPayload} {
+		if text == "" {
+			continue
+		}
+		tmpl, err := p.template(text, device)
+		if err == nil {
+			_, err = tmpl.Generate(0, time.Now())
+		}
+		if err != nil {
+			return fmt.Errorf("profile %v: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// deviceTopic replaces {device} by the device id
+func deviceTopic(topic string, device string) string {
+	return strings.ReplaceAll(topic, "{device}", device)
+}
+
+// template parses a payload template of the device
+func (p *DeviceProfile) template(text string, device string) (*PayloadTemplate, error) {
+	return newPayloadTemplate(deviceTopic(text, device), device)
+}
+
+// parseDeviceMix parses a comma separated list of <profile>:<weight>, e.g. thermostat:70,gateway:10,tracker:20
+func parseDeviceMix(value string, profiles map[string]*DeviceProfile) ([]Pair[*DeviceProfile, float64], error) {
+	mix := []Pair[*DeviceProfile, float64]{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, weight, found := strings.Cut(s, ":")
+		p := profiles[name]
+		if p == nil {
+			return nil, fmt.Errorf("unknown device profile %q", name)
+		}
+		for _, m := range mix {
+			if m.First == p {
+				return nil, fmt.Errorf("device profile %v listed twice", name)
+			}
+		}
+		w := 1.0
+		if found {
+			var err error
+			if w, err = strconv.ParseFloat(weight, 64); err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight %q of device profile %v", weight, name)
+			}
+		}
+		mix = append(mix, Pair[*DeviceProfile, float64]{p, w})
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("empty device mix")
+	}
+	return mix, nil
+}
+
+// Device is a simulated device of the fleet
+type Device struct {
+	ID      string
+	Profile *DeviceProfile
+}
+
+// expandDevices returns count devices split between the profiles of the mix according to their weights, the
+// remainders going to the largest fractions. The profiles are interleaved so that a ramp up starts them all alike
+func expandDevices(mix []Pair[*DeviceProfile, float64], count int) []Device {
+	total := 0.0
+	for _, m := range mix {
+		total += m.Second
+	}
+	counts := make([]int, len(mix))
+	order := make([]int, len(mix))
+	assigned := 0
+	for i, m := range mix {
+		counts[i] = int(float64(count) * m.Second / total)
+		assigned += counts[i]
+		order[i] = i
+	}
+	fraction := func(i int) float64 {
+		return float64(count)*mix[i].Second/total - float64(counts[i])
+	}
+	sort.SliceStable(order, func(i, j int) bool { return fraction(order[i]) > fraction(order[j]) })
+	for i := 0; assigned < count; i++ {
+		counts[order[i%len(order)]]++
+		assigned++
+	}
+
+	devices := []Device{}
+	next := make([]int, len(mix))
+	for len(devices) < count {
+		for i, m := range mix {
+			// the profile goes next while it is behind its share of the devices started so far
+			if next[i] < counts[i] && float64(next[i]) <= float64(len(devices))*float64(counts[i])/float64(count) {
+				devices = append(devices, Device{ID: fmt.Sprintf("%v-%v", m.First.Name, next[i]), Profile: m.First})
+				next[i]++
+			}
+		}
+	}
+	return devices
+}
+
+// messagesOn returns the number of messages published on the i-th of n topics, the messages going to the topics in
+// turn
+func messagesOn(i int, n int, count int) int {
+	if i >= count {
+		return 0
+	}
+	return (count - i + n - 1) / n
+}
+
+// ProfileResults describes the devices of a profile: their telemetry received by the backend subscribers, and the
+// commands they received
+type ProfileResults struct {
+	Profile          string  `json:"profile"`
+	Devices          int     `json:"devices"`
+	Connections      int     `json:"connections"` // opened by the devices, their telemetry and commands connections
+	Published        int64   `json:"published"`
+	Expected         int64   `json:"expected"`
+	Received         int64   `json:"received"`
+	MsgTimeAvg       float64 `json:"msg_time_mean_avg"`
+	MsgTimeP99       float64 `json:"msg_time_p99"`
+	Commands         int64   `json:"commands"`
+	CommandsExpected int64   `json:"commands_expected"`
+	CommandsReceived int64   `json:"commands_received"`
+	CommandTimeAvg   float64 `json:"command_time_mean_avg"`
+	CommandTimeP99   float64 `json:"command_time_p99"`
+}
+
+// calculateProfileResults completes the results of a profile, whose devices and expected messages are set, with the
+// results of its devices and of its backend publishers (commands) and subscribers (telemetry)
+func calculateProfileResults(res *ProfileResults, devices []*RunResults, commanders []*RunResults, backend []*SubscriberResults, commands []*SubscriberResults, telemetryLatencies []uint64, commandLatencies []uint64) *ProfileResults {
+	for _, r := range devices {
+		res.Published += r.Successes
+	}
+	for _, r := range commanders {
+		res.Commands += r.Successes
+	}
+	for _, sub := range backend {
+		res.Received += sub.Received
+	}
+	for _, sub := range commands {
+		res.CommandsReceived += sub.Received
+	}
+	if len(telemetryLatencies) > 0 {
+		l := stats.LoadRawData(telemetryLatencies)
+		res.MsgTimeAvg, _ = stats.Mean(l)
+		res.MsgTimeP99, _ = stats.Percentile(l, 99)
+	}
+	if len(commandLatencies) > 0 {
+		l := stats.LoadRawData(commandLatencies)
+		res.CommandTimeAvg, _ = stats.Mean(l)
+		res.CommandTimeP99, _ = stats.Percentile(l, 99)
+	}
+	return res
+}
+
+// DeviceFleet simulates a fleet of devices split between the profiles of a mix. Every device publishes on one
+// connection and, when its profile has commands, subscribes to them on a second one, so that a fleet of N devices opens
+// up to 2N connections, besides the backend subscribers and command publishers
+type DeviceFleet struct {
+	BrokerURL       string
+	BrokerUser      string
+	BrokerPass      string
+	TLSConfig       *tls.Config
+	Mix             []Pair[*DeviceProfile, float64]
+	Devices         int
+	Subscribers     int // number of backend subscribers per profile topic
+	MsgCount        int
+	MsgSize         int  // default size of the profiles
+	MsgQoS          byte // default QoS of the profiles
+	MessageInterval int  // default interval of the profiles
+	ConnectRate     int  // devices started per second, 0 starts them all at once
+	WaitTimeout     time.Duration
+	KeepAlive       time.Duration
+	CleanSession    bool
+	Verify          bool
+	Inflight        int
+	NoHeader        bool // templated payloads are sent without the header
+	Encoding        PayloadEncoding
+	EncodingName    string
+	Content         *PayloadContent
+	Integrity       *Integrity
+	Remote          bool
+	RemoteUser      string
+	RemotePwd       string
+	Quiet           bool
+}
+
+// DeviceFleetResults adds to the results of every client the results per profile and the number of connections
+// opened by the devices, backend subscribers and command publishers
+type DeviceFleetResults struct {
+	*JSONResults
+	Devices     int               `json:"devices"`
+	Connections int               `json:"connections"`
+	Profiles    []*ProfileResults `json:"profiles"`
+}
+
+func (b *DeviceFleet) qosOf(p *DeviceProfile) byte {
+	if p.QoS != nil {
+		return byte(*p.QoS)
+	}
+	return b.MsgQoS
+}
+
+func (b *DeviceFleet) intervalOf(p *DeviceProfile) int {
+	if p.Interval > 0 {
+		return p.Interval
+	}
+	return b.MessageInterval
+}
+
+func (b *DeviceFleet) sizeOf(p *DeviceProfile) int {
+	if p.Size > 0 {
+		return p.Size
+	}
+	return b.MsgSize
+}
+
+// commandsOf returns the number of commands sent to every device of the profile while its telemetry runs
+func (b *DeviceFleet) commandsOf(p *DeviceProfile) int {
+	if p.Commands == "" {
+		return 0
+	}
+	if n := b.MsgCount * b.intervalOf(p) / p.CommandInterval; n > 1 {
+		return n
+	}
+	return 1
+}
+
+func (b *DeviceFleet) headerless(template string) bool {
+	return template != "" && b.NoHeader && b.Encoding == nil
+}
+
+func (b *DeviceFleet) generator(template string, device string) PayloadGenerator {
+	if template == "" {
+		return nil
+	}
+	p, _ := newPayloadTemplate(deviceTopic(template, device), device)
+	return p
+}
+
+// commandGenerator renders the command payload of every device, the commands being sent to the devices in turn
+type commandGenerator []PayloadGenerator
+
+func (g commandGenerator) Generate(seq int, sent time.Time) ([]byte, error) {
+	return g[seq%len(g)].Generate(seq, sent)
+}
+
+// commands returns the generator of the command payloads sent to the devices, nil without template
+func (b *DeviceFleet) commands(template string, devices []string) PayloadGenerator {
+	if template == "" {
+		return nil
+	}
+	g := commandGenerator{}
+	for _, device := range devices {
+		g = append(g, b.generator(template, device))
+	}
+	return g
+}
+
+// Run starts the backend subscribers, then the devices at ConnectRate and the command publishers, and waits for all
+// of them
+func (b *DeviceFleet) Run() *DeviceFleetResults {
+	fleet := expandDevices(b.Mix, b.Devices)
+	runStamp := time.Now().UTC().UnixMilli()
+	// the subscribers wait for every device to be started
+	startup := 0
+	if b.ConnectRate > 0 {
+		startup = b.Devices / b.ConnectRate
+	}
+
+	// messages published on every telemetry topic
+	published := map[string]int{}
+	profileDevices := map[*DeviceProfile]int{}
+	for _, d := range fleet {
+		profileDevices[d.Profile]++
+		for i, t := range d.Profile.Topics {
+			published[deviceTopic(t, d.ID)] += messagesOn(i, len(d.Profile.Topics), b.MsgCount)
+		}
+	}
+
+	resCh := make(chan *RunResults)
+	subResCh := make(chan *SubscriberResults)
+	latenciesPointers := []*[]uint64{}
+	subscriberCount := 0
+	startSubscriber := func(id string, clientID string, topic string, expected int, qos byte, timeout int, noHeader bool, ready *sync.WaitGroup) *[]uint64 {
+		array := []uint64{}
+		c := &SubscriberClient{
+			ID:            id,
+			ClientID:      clientID,
+			BrokerURL:     b.BrokerURL,
+			BrokerUser:    b.BrokerUser,
+			BrokerPass:    b.BrokerPass,
+			MsgTopic:      topic,
+			TopicMsgCount: expected,
+			MsgQoS:        qos,
+			TLSConfig:     b.TLSConfig,
+			Quiet:         b.Quiet,
+			Timeout:       timeout,
+			CleanSession:  b.CleanSession,
+			KeepAlive:     b.KeepAlive,
+			Ready:         ready,
+			NoHeader:      noHeader,
+			Decoder:       b.Encoding,
+			Integrity:     b.Integrity,
+		}
+		latenciesPointers = append(latenciesPointers, &array)
+		subscriberCount++
+		ready.Add(1)
+		go c.Run(subResCh, &array)
+		return &array
+	}
+
+	// backend subscribers consume the telemetry of a profile, {device} being a wildcard, and expect every message of
+	// the topics they match
+	subscribed := &sync.WaitGroup{}
+	backendProfiles := map[string]*DeviceProfile{}
+	backendLatencies := map[*DeviceProfile][]*[]uint64{}
+	expected := map[*DeviceProfile]int64{}
+	for _, m := range b.Mix {
+		p := m.First
+		filters := map[string]bool{}
+		for t, topic := range p.Topics {
+			filter := deviceTopic(topic, "+")
+			if filters[filter] {
+				continue
+			}
+			filters[filter] = true
+			n := 0
+			for name, messages := range published {
+				if topicMatches(filter, name) {
+					n += messages
+				}
+			}
+			for i := 0; i < b.Subscribers; i++ {
+				id := fmt.Sprintf("backend-%v-%v-%v", p.Name, t, i)
+				timeout := 15 + startup + 2*b.intervalOf(p)/1000
+				array := startSubscriber(id, fmt.Sprintf("subscriber-%v-%v", id, runStamp), filter, n, b.qosOf(p), timeout, b.headerless(p.Payload), subscribed)
+				backendProfiles[id] = p
+				backendLatencies[p] = append(backendLatencies[p], array)
+				expected[p] += int64(n)
+			}
+		}
+	}
+	subscribed.Wait()
+
+	// devices subscribe to their commands and publish their telemetry, started at ConnectRate
+	var ticker *time.Ticker
+	if b.ConnectRate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(b.ConnectRate))
+		defer ticker.Stop()
+	}
+	commandsReady := &sync.WaitGroup{}
+	fleetProfiles := map[string]*DeviceProfile{}
+	commandLatencies := map[*DeviceProfile][]*[]uint64{}
+	start := time.Now()
+	for _, d := range fleet {
+		if ticker != nil {
+			<-ticker.C
+		}
+		p := d.Profile
+		fleetProfiles[d.ID] = p
+		if n := b.commandsOf(p); n > 0 {
+			timeout := 15 + startup + 2*p.CommandInterval/1000
+			array := startSubscriber(d.ID, fmt.Sprintf("device-%v-commands-%v", d.ID, runStamp), deviceTopic(p.Commands, d.ID), n, b.qosOf(p), timeout, b.headerless(p.CommandPayload), commandsReady)
+			commandLatencies[p] = append(commandLatencies[p], array)
+		}
+		topics := []string{}
+		for _, t := range p.Topics {
+			topics = append(topics, deviceTopic(t, d.ID))
+		}
+		if !b.Quiet {
+			log.Println("Starting DEVICE", d.ID)
+		}
+		c := &PublisherClient{
+			ID:              d.ID,
+			ClientID:        fmt.Sprintf("device-%v-%v", d.ID, runStamp),
+			BrokerURL:       b.BrokerURL,
+			BrokerUser:      b.BrokerUser,
+			BrokerPass:      b.BrokerPass,
+			MsgTopics:       topics,
+			MsgSize:         b.sizeOf(p),
+			MsgCount:        b.MsgCount,
+			MsgQoS:          b.qosOf(p),
+			Quiet:           b.Quiet,
+			WaitTimeout:     b.WaitTimeout,
+			TLSConfig:       b.TLSConfig,
+			MessageInterval: b.intervalOf(p),
+			RemoteUser:      b.RemoteUser,
+			RemotePwd:       b.RemotePwd,
+			Remote:          b.Remote,
+			CleanSession:    b.CleanSession,
+			KeepAlive:       b.KeepAlive,
+			Verify:          b.Verify,
+			Inflight:        b.Inflight,
+			Payload:         b.generator(p.Payload, d.ID),
+			NoHeader:        b.headerless(p.Payload),
+			Encoding:        b.Encoding,
+			Content:         b.Content,
+			Integrity:       b.Integrity,
+		}
+		go c.Run(resCh)
+	}
+	commandsReady.Wait()
+
+	// a backend publisher per profile sends the commands to its devices in turn
+	commanderProfiles := map[string]*DeviceProfile{}
+	for _, m := range b.Mix {
+		p := m.First
+		n := b.commandsOf(p)
+		if n == 0 || profileDevices[p] == 0 {
+			continue
+		}
+		topics, devices := []string{}, []string{}
+		for _, d := range fleet {
+			if d.Profile == p {
+				topics = append(topics, deviceTopic(p.Commands, d.ID))
+				devices = append(devices, d.ID)
+			}
+		}
+		interval := p.CommandInterval / len(topics)
+		if interval < 1 {
+			interval = 1
+		}
+		id := "commands-" + p.Name
+		clientID := fmt.Sprintf("publisher-%v-%v", id, runStamp)
+		commanderProfiles[id] = p
+		c := &PublisherClient{
+			ID:              id,
+			ClientID:        clientID,
+			BrokerURL:       b.BrokerURL,
+			BrokerUser:      b.BrokerUser,
+			BrokerPass:      b.BrokerPass,
+			MsgTopics:       topics,
+			MsgSize:         commandSize,
+			MsgCount:        n * len(topics),
+			MsgQoS:          b.qosOf(p),
+			Quiet:           b.Quiet,
+			WaitTimeout:     b.WaitTimeout,
+			TLSConfig:       b.TLSConfig,
+			MessageInterval: interval,
+			RemoteUser:      b.RemoteUser,
+			RemotePwd:       b.RemotePwd,
+			Remote:          b.Remote,
+			CleanSession:    true,
+			KeepAlive:       b.KeepAlive,
+			Verify:          b.Verify,
+			Inflight:        b.Inflight,
+			Payload:         b.commands(p.CommandPayload, devices),
+			NoHeader:        b.headerless(p.CommandPayload),
+			Encoding:        b.Encoding,
+			Content:         b.Content,
+			Integrity:       b.Integrity,
+		}
+		go c.Run(resCh)
+	}
+
+	publisherCount := len(fleet) + len(commanderProfiles)
+	results := make([]*RunResults, publisherCount)
+	for i := range results {
+		results[i] = <-resCh
+	}
+	totalTime := time.Since(start)
+	subResults := make([]*SubscriberResults, subscriberCount)
+	for i := range subResults {
+		subResults[i] = <-subResCh
+	}
+	latencies := []uint64{}
+	for _, arrayPointer := range latenciesPointers {
+		latencies = append(latencies, *arrayPointer...)
+	}
+	totals := calculateTotalResults(results, totalTime, publisherCount, latencies, subResults)
+	if b.Encoding != nil {
+		totals.Encoding = b.EncodingName
+	}
+	if b.Integrity != nil {
+		totals.Integrity = b.Integrity.Algorithm
+	}
+	totals.Topics = len(published)
+	for t := range published {
+		if depth := len(strings.Split(t, "/")); depth > totals.TopicDepth {
+			totals.TopicDepth = depth
+		}
+	}
+
+	res := &DeviceFleetResults{Devices: len(fleet), Connections: publisherCount + subscriberCount}
+	for _, m := range b.Mix {
+		p := m.First
+		runs, commanders := []*RunResults{}, []*RunResults{}
+		for _, r := range results {
+			if fleetProfiles[r.ID] == p {
+				runs = append(runs, r)
+			} else if commanderProfiles[r.ID] == p {
+				commanders = append(commanders, r)
+			}
+		}
+		backend, commands := []*SubscriberResults{}, []*SubscriberResults{}
+		for _, sub := range subResults {
+			if backendProfiles[sub.ID] == p {
+				backend = append(backend, sub)
+			} else if fleetProfiles[sub.ID] == p {
+				commands = append(commands, sub)
+			}
+		}
+		telemetryLatencies, commandsLatencies := []uint64{}, []uint64{}
+		for _, arrayPointer := range backendLatencies[p] {
+			telemetryLatencies = append(telemetryLatencies, *arrayPointer...)
+		}
+		for _, arrayPointer := range commandLatencies[p] {
+			commandsLatencies = append(commandsLatencies, *arrayPointer...)
+		}
+		profile := &ProfileResults{
+			Profile:          p.Name,
+			Devices:          profileDevices[p],
+			Connections:      profileDevices[p] + len(commands),
+			Expected:         expected[p],
+			CommandsExpected: int64(b.commandsOf(p) * profileDevices[p]),
+		}
+		res.Profiles = append(res.Profiles, calculateProfileResults(profile, runs, commanders, backend, commands, telemetryLatencies, commandsLatencies))
+	}
+
+	var verifyResults *VerifyResults
+	if b.Verify {
+		// the guarantee checked is the one of the lowest QoS of the mix
+		lowest := byte(2)
+		for _, m := range b.Mix {
+			if q := b.qosOf(m.First); q < lowest {
+				lowest = q
+			}
+		}
+		verifyResults = calculateVerifyResults(lowest, results, subResults, totals)
+	}
+	res.JSONResults = &JSONResults{Runs: results, Subscribers: subResults, Verify: verifyResults, Totals: totals}
+	return res
+}
+
+func printDeviceFleetResults(res *DeviceFleetResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		printResults(res.JSONResults, format)
+		fmt.Printf("========= FLEET (%d devices) =========\n", res.Devices)
+		fmt.Printf("Connections:                 %d\n", res.Connections)
+		for _, p := range res.Profiles {
+			fmt.Printf("======= PROFILE %v (%d devices) =======\n", p.Profile, p.Devices)
+			fmt.Printf("Device connections:          %d\n", p.Connections)
+			fmt.Printf("Published:                   %d\n", p.Published)
+			fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(p.Received)/float64(p.Expected), p.Received, p.Expected)
+			fmt.Printf("Msg time mean (ms):          %.3f\n", p.MsgTimeAvg)
+			fmt.Printf("Msg time p99 (ms):           %.3f\n", p.MsgTimeP99)
+			if p.CommandsExpected > 0 {
+				fmt.Printf("Commands sent:               %d\n", p.Commands)
+				fmt.Printf("Commands ratio:              %.3f (%d/%d)\n", float64(p.CommandsReceived)/float64(p.CommandsExpected), p.CommandsReceived, p.CommandsExpected)
+				fmt.Printf("Command time mean (ms):      %.3f\n", p.CommandTimeAvg)
+				fmt.Printf("Command time p99 (ms):       %.3f\n", p.CommandTimeP99)
+			}
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Fields carrying the latency metadata inside encoded messages, in place of the header
+const (
+	benchTimestamp = "bench_ts"
+	benchPublisher = "bench_publisher"
+	benchSeq       = "bench_seq"
+)
+
+// PayloadEncoding encodes the fields of a message into a structured payload, e.g. for subscribers measuring the cost of
+// decoding. Decoded values are maps, slices, strings, []byte, uint64, int64, float64, bool or nil
+type PayloadEncoding interface {
+	Encode(fields map[string]interface{}) ([]byte, error)
+	Decode(payload []byte) (map[string]interface{}, error)
+}
+
+// newPayloadEncoding returns the encoding of the given name, nil for raw payloads
+func newPayloadEncoding(name string, descriptor string, message string) (PayloadEncoding, error) {
+	switch name {
+	case "", "raw":
+		return nil, nil
+	case "json":
+		return jsonEncoding{}, nil
+	case "cbor":
+		return cborEncoding{}, nil
+	case "msgpack":
+		return msgpackEncoding{}, nil
+	case "protobuf":
+		if descriptor == "" || message == "" {
+			return nil, fmt.Errorf("protobuf encoding needs -proto-descriptor and -proto-message")
+		}
+		return loadProtoEncoding(descriptor, message)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+}
+
+// encodeMessage encodes fields with the latency metadata of a message
+func encodeMessage(e PayloadEncoding, fields map[string]interface{}, sent time.Time, publisher uint32, seq uint32) ([]byte, error) {
+	fields[benchTimestamp] = uint64(sent.UTC().UnixMilli())
+	fields[benchPublisher] = uint64(publisher)
+	fields[benchSeq] = uint64(seq)
+	return e.Encode(fields)
+}
+
+// decodeMessage decodes a payload and returns its latency metadata
+func decodeMessage(e PayloadEncoding, payload []byte) (msgHeader, error) {
+	fields, err := e.Decode(payload)
+	if err != nil {
+		return msgHeader{}, err
+	}
+	sent, ok1 := toUint64(fields[benchTimestamp])
+	publisher, ok2 := toUint64(fields[benchPublisher])
+	seq, ok3 := toUint64(fields[benchSeq])
+	if !ok1 || !ok2 || !ok3 {
+		return msgHeader{}, fmt.Errorf("message without %v, %v and %v", benchTimestamp, benchPublisher, benchSeq)
+	}
+	return msgHeader{Sent: sent, Publisher: uint32(publisher), Seq: uint32(seq)}, nil
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return n, true
+	case int64:
+		return uint64(n), n >= 0
+	case float64:
+		return uint64(n), n >= 0 && n == math.Trunc(n)
+	}
+	return 0, false
+}
+
+// integer returns the integer value of a whole float, as JSON numbers decode as float64
+func integer(f float64) (int64, bool) {
+	if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) Encode(fields map[string]interface{}) ([]byte, error) {
+	return json.Marshal(fields)
+}
+
+func (jsonEncoding) Decode(payload []byte) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	err := json.Unmarshal(payload, &fields)
+	return fields, err
+}
+
+// cborEncoding writes definite length CBOR (RFC 8949) with sorted map keys
+type cborEncoding struct{}
+
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
+
+func appendCBORInt(b []byte, n int64) []byte {
+	if n < 0 {
+		return appendCBORHead(b, 1, uint64(-(n + 1)))
+	}
+	return appendCBORHead(b, 0, uint64(n))
+}
+
+func appendCBOR(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xf6), nil
+	case bool:
+		if v {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case uint64:
+		return appendCBORHead(b, 0, v), nil
+	case int64:
+		return appendCBORInt(b, v), nil
+	case float64:
+		if n, ok := integer(v); ok {
+			return appendCBORInt(b, n), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(v)), nil
+	case string:
+		return append(appendCBORHead(b, 3, uint64(len(v))), v...), nil
+	case []byte:
+		return append(appendCBORHead(b, 2, uint64(len(v))), v...), nil
+	case []interface{}:
+		b = appendCBORHead(b, 4, uint64(len(v)))
+		for _, item := range v {
+			if b, err = appendCBOR(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendCBORHead(b, 5, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			b = append(appendCBORHead(b, 3, uint64(len(k))), k...)
+			if b, err = appendCBOR(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot encode %T in CBOR", v)
+}
+
+func (cborEncoding) Encode(fields map[string]interface{}) ([]byte, error) {
+	return appendCBOR(nil, fields)
+}
+
+func (cborEncoding) Decode(payload []byte) (map[string]interface{}, error) {
+	v, rest, err := readCBOR(payload)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok || len(rest) > 0 {
+		return nil, fmt.Errorf("CBOR payload is not a single map")
+	}
+	return fields, nil
+}
+
+func readCBOR(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("truncated CBOR")
+	}
+	major, info := b[0]>>5, b[0]&31
+	b = b[1:]
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(b) >= 1:
+		n, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		n, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		n, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		n, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported or truncated CBOR item")
+	}
+	switch major {
+	case 0:
+		return n, b, nil
+	case 1:
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if uint64(len(b)) < n {
+			return nil, nil, fmt.Errorf("truncated CBOR string")
+		}
+		if major == 2 {
+			return append([]byte{}, b[:n]...), b[n:], nil
+		}
+		return string(b[:n]), b[n:], nil
+	case 4:
+		// every item takes at least a byte, a larger count is corrupted and must not be allocated
+		if uint64(len(b)) < n {
+			return nil, nil, fmt.Errorf("truncated CBOR array")
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			item, rest, err := readCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, b = append(items, item), rest
+		}
+		return items, b, nil
+	case 5:
+		if uint64(len(b)) < n {
+			return nil, nil, fmt.Errorf("truncated CBOR map")
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, rest, err := readCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("CBOR map key is not a string")
+			}
+			if m[key], b, err = readCBOR(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, b, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), b, nil
+		case 27:
+			return math.Float64frombits(n), b, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unsupported CBOR item")
+}
+
+// msgpackEncoding writes MessagePack with sorted map keys
+type msgpackEncoding struct{}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendMsgpackUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendMsgpackUint(b []byte, n uint64) []byte {
+	switch {
+	case n < 128:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+}
+
+// appendMsgpackHead writes the head of a string, binary, array or map of length n given its fix prefix and 8, 16 and
+// 32 bits codes, 0 when the type has no such code
+func appendMsgpackHead(b []byte, n int, fix byte, fixMax int, c8, c16, c32 byte) []byte {
+	switch {
+	case fix != 0 && n <= fixMax:
+		return append(b, fix|byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		return append(b, c8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, c16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, c32), uint32(n))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	return append(appendMsgpackHead(b, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb), s...)
+}
+
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case uint64:
+		return appendMsgpackUint(b, v), nil
+	case int64:
+		return appendMsgpackInt(b, v), nil
+	case float64:
+		if n, ok := integer(v); ok {
+			return appendMsgpackInt(b, n), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v)), nil
+	case string:
+		return appendMsgpackString(b, v), nil
+	case []byte:
+		return append(appendMsgpackHead(b, len(v), 0, 0, 0xc4, 0xc5, 0xc6), v...), nil
+	case []interface{}:
+		b = appendMsgpackHead(b, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgpackHead(b, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			b = appendMsgpackString(b, k)
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot encode %T in MessagePack", v)
+}
+
+func (msgpackEncoding) Encode(fields map[string]interface{}) ([]byte, error) {
+	return appendMsgpack(nil, fields)
+}
+
+func (msgpackEncoding) Decode(payload []byte) (map[string]interface{}, error) {
+	v, rest, err := readMsgpack(payload)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok || len(rest) > 0 {
+		return nil, fmt.Errorf("MessagePack payload is not a single map")
+	}
+	return fields, nil
+}
+
+// readMsgpackLen reads a big endian length of size bytes
+func readMsgpackLen(b []byte, size int) (int, []byte, error) {
+	if len(b) < size {
+		return 0, nil, fmt.Errorf("truncated MessagePack")
+	}
+	switch size {
+	case 1:
+		return int(b[0]), b[1:], nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), b[2:], nil
+	}
+	return int(binary.BigEndian.Uint32(b)), b[4:], nil
+}
+
+func readMsgpack(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("truncated MessagePack")
+	}
+	c := b[0]
+	b = b[1:]
+	var n int
+	var err error
+	switch {
+	case c < 0x80:
+		return uint64(c), b, nil
+	case c >= 0xe0:
+		return int64(int8(c)), b, nil
+	case c >= 0xa0 && c <= 0xbf:
+		return readMsgpackString(b, int(c&31))
+	case c >= 0x90 && c <= 0x9f:
+		return readMsgpackArray(b, int(c&15))
+	case c >= 0x80 && c <= 0x8f:
+		return readMsgpackMap(b, int(c&15))
+	}
+	switch c {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xcc, 0xcd, 0xce, 0xcf, 0xd0, 0xd1, 0xd2, 0xd3, 0xca, 0xcb:
+		size := map[byte]int{0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, 0xca: 4, 0xcb: 8}[c]
+		if len(b) < size {
+			return nil, nil, fmt.Errorf("truncated MessagePack number")
+		}
+		var u uint64
+		for _, x := range b[:size] {
+			u = u<<8 | uint64(x)
+		}
+		b = b[size:]
+		switch c {
+		case 0xca:
+			return float64(math.Float32frombits(uint32(u))), b, nil
+		case 0xcb:
+			return math.Float64frombits(u), b, nil
+		case 0xd0:
+			return int64(int8(u)), b, nil
+		case 0xd1:
+			return int64(int16(u)), b, nil
+		case 0xd2:
+			return int64(int32(u)), b, nil
+		case 0xd3:
+			return int64(u), b, nil
+		}
+		return u, b, nil
+	case 0xd9, 0xda, 0xdb:
+		if n, b, err = readMsgpackLen(b, map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4}[c]); err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackString(b, n)
+	case 0xc4, 0xc5, 0xc6:
+		if n, b, err = readMsgpackLen(b, map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4}[c]); err != nil {
+			return nil, nil, err
+		}
+		if len(b) < n {
+			return nil, nil, fmt.Errorf("truncated MessagePack binary")
+		}
+		return append([]byte{}, b[:n]...), b[n:], nil
+	case 0xdc, 0xdd:
+		if n, b, err = readMsgpackLen(b, map[byte]int{0xdc: 2, 0xdd: 4}[c]); err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackArray(b, n)
+	case 0xde, 0xdf:
+		if n, b, err = readMsgpackLen(b, map[byte]int{0xde: 2, 0xdf: 4}[c]); err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackMap(b, n)
+	}
+	return nil, nil, fmt.Errorf("unsupported MessagePack type 0x%x", c)
+}
+
+func readMsgpackString(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("truncated MessagePack string")
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func readMsgpackArray(b []byte, n int) (interface{}, []byte, error) {
+	// every item takes at least a byte, a larger count is corrupted and must not be allocated
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("truncated MessagePack array")
+	}
+	items := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		item, rest, err := readMsgpack(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		items, b = append(items, item), rest
+	}
+	return items, b, nil
+}
+
+func readMsgpackMap(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("truncated MessagePack map")
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, rest, err := readMsgpack(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("MessagePack map key is not a string")
+		}
+		if m[key], b, err = readMsgpack(rest); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m, b, nil
+}
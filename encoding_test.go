@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleFields holds every decoded type, with lengths crossing the short and 8 bits heads
+func sampleFields() map[string]interface{} {
+	list := []interface{}{}
+	for i := 0; i < 20; i++ {
+		list = append(list, uint64(i*1000))
+	}
+	return map[string]interface{}{
+		"uint":     uint64(math.MaxUint64),
+		"negative": int64(-1 << 40),
+		"small":    int64(-5),
+		"float":    21.5,
+		"bool":     true,
+		"nil":      nil,
+		"short":    "temp",
+		"long":     strings.Repeat("x", 300),
+		"bytes":    []byte{0, 1, 2, 0xff},
+		"list":     list,
+		"nested":   map[string]interface{}{"lat": 45.5, "lon": -73.5, "id": "device-1"},
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, name := range []string{"cbor", "msgpack"} {
+		e, err := newPayloadEncoding(name, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := e.Encode(sampleFields())
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		fields, err := e.Decode(payload)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if !reflect.DeepEqual(fields, sampleFields()) {
+			t.Errorf("%v: decoded %v, expected %v", name, fields, sampleFields())
+		}
+	}
+}
+
+func TestEncodingMetadata(t *testing.T) {
+	sent := time.UnixMilli(1700000000123)
+	for _, name := range []string{"json", "cbor", "msgpack"} {
+		e, _ := newPayloadEncoding(name, "", "")
+		payload, err := encodeMessage(e, map[string]interface{}{"temp": 20.5}, sent, 7, 42)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		h, err := decodeMessage(e, payload)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if h.Sent != uint64(sent.UnixMilli()) || h.Publisher != 7 || h.Seq != 42 {
+			t.Errorf("%v: decoded %+v", name, h)
+		}
+	}
+}
+
+func TestEncodingCorrupted(t *testing.T) {
+	for _, name := range []string{"cbor", "msgpack"} {
+		e, _ := newPayloadEncoding(name, "", "")
+		payload, _ := e.Encode(sampleFields())
+		for i := 0; i < len(payload); i++ {
+			if _, err := e.Decode(payload[:i]); err == nil {
+				t.Errorf("%v: payload truncated to %v bytes decoded", name, i)
+			}
+		}
+		// mutations must fail or decode, never panic
+		random := rand.New(rand.NewSource(1))
+		for i := 0; i < 10000; i++ {
+			mutated := append([]byte{}, payload...)
+			mutated[random.Intn(len(mutated))] = byte(random.Intn(256))
+			e.Decode(mutated)
+		}
+	}
+
+	// counts far larger than the payload are rejected before allocating
+	for name, payload := range map[string][]byte{
+		"cbor array":    {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"cbor map":      {0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"msgpack array": {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"msgpack map":   {0xdf, 0xff, 0xff, 0xff, 0xff},
+	} {
+		var err error
+		if strings.HasPrefix(name, "cbor") {
+			_, _, err = readCBOR(payload)
+		} else {
+			_, _, err = readMsgpack(payload)
+		}
+		if err == nil {
+			t.Errorf("%v with a huge count decoded", name)
+		}
+	}
+}
+
+// descriptorField writes a FieldDescriptorProto
+func descriptorField(name string, number int, repeated bool, kind int, typeName string) []byte {
+	label := uint64(1)
+	if repeated {
+		label = 3
+	}
+	b := appendProtoBytes(nil, 1, []byte(name))
+	b = appendProtoVarint(b, 3, uint64(number))
+	b = appendProtoVarint(b, 4, label)
+	b = appendProtoVarint(b, 5, uint64(kind))
+	if typeName != "" {
+		b = appendProtoBytes(b, 6, []byte(typeName))
+	}
+	return b
+}
+
+// writeDescriptor writes the FileDescriptorSet of bench.Reading and returns its path
+func writeDescriptor(t *testing.T) string {
+	location := appendProtoBytes(nil, 1, []byte("Location"))
+	location = appendProtoBytes(location, 2, descriptorField("lat", 1, false, protoTypeDouble, ""))
+	location = appendProtoBytes(location, 2, descriptorField("lon", 2, false, protoTypeDouble, ""))
+
+	reading := appendProtoBytes(nil, 1, []byte("Reading"))
+	for _, f := range [][]byte{
+		descriptorField(benchTimestamp, 1, false, protoTypeUint64, ""),
+		descriptorField(benchPublisher, 2, false, protoTypeUint64, ""),
+		descriptorField(benchSeq, 3, false, protoTypeUint64, ""),
+		descriptorField("temp", 4, false, protoTypeDouble, ""),
+		descriptorField("name", 5, false, protoTypeString, ""),
+		descriptorField("tags", 6, true, protoTypeString, ""),
+		descriptorField("values", 7, true, protoTypeSint64, ""),
+		descriptorField("location", 8, false, protoTypeMessage, ".bench.Reading.Location"),
+	} {
+		reading = appendProtoBytes(reading, 2, f)
+	}
+	reading = appendProtoBytes(reading, 3, location)
+
+	file := appendProtoBytes(nil, 2, []byte("bench"))
+	file = appendProtoBytes(file, 4, reading)
+	path := filepath.Join(t.TempDir(), "bench.desc")
+	if err := os.WriteFile(path, appendProtoBytes(nil, 1, file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProtoEncodingRoundTrip(t *testing.T) {
+	e, err := newPayloadEncoding("protobuf", writeDescriptor(t), "bench.Reading")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// numbers as decoded from a JSON template
+	payload, err := encodeMessage(e, map[string]interface{}{
+		"temp":     21.5,
+		"name":     "thermostat-1",
+		"tags":     []interface{}{"a", "b"},
+		"values":   []interface{}{float64(-3), float64(5)},
+		"location": map[string]interface{}{"lat": 45.5, "lon": -73.5},
+	}, time.UnixMilli(1700000000123), 7, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := e.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		benchTimestamp: uint64(1700000000123),
+		benchPublisher: uint64(7),
+		benchSeq:       uint64(42),
+		"temp":         21.5,
+		"name":         "thermostat-1",
+		"tags":         []interface{}{"a", "b"},
+		"values":       []interface{}{int64(-3), int64(5)},
+		"location":     map[string]interface{}{"lat": 45.5, "lon": -73.5},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("decoded %v, expected %v", fields, expected)
+	}
+
+	// repeated scalars are also read packed
+	packed := appendProtoBytes(nil, 7, []byte{5, 10})
+	if fields, err := e.Decode(packed); err != nil || !reflect.DeepEqual(fields["values"], []interface{}{int64(-3), int64(5)}) {
+		t.Errorf("packed values decoded as %v, %v", fields["values"], err)
+	}
+}
+
+func TestProtoEncodingCorrupted(t *testing.T) {
+	e, _ := newPayloadEncoding("protobuf", writeDescriptor(t), "bench.Reading")
+	payload, _ := encodeMessage(e, map[string]interface{}{"name": "thermostat-1", "temp": 21.5}, time.Now(), 1, 2)
+	for name, corrupted := range map[string][]byte{
+		"truncated string":  payload[:len(payload)-3],
+		"truncated fixed64": {0x21, 0, 0},
+		"truncated packed":  appendProtoBytes(nil, 7, []byte{0x80}),
+		"invalid wire type": {0x0f},
+		"invalid tag":       {0x80},
+	} {
+		if _, err := e.Decode(corrupted); err == nil {
+			t.Errorf("%v decoded", name)
+		}
+	}
+	// an empty packed value of a single field is ignored
+	if _, err := e.Decode(appendProtoBytes(nil, 4, nil)); err != nil {
+		t.Errorf("empty packed field: %v", err)
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		mutated := append([]byte{}, payload...)
+		mutated[random.Intn(len(mutated))] = byte(random.Intn(256))
+		e.Decode(mutated)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/montanaflynn/stats"
+)
+
+// FanInResults describes results of the wildcard subscribers aggregating the topics matched by a filter
+type FanInResults struct {
+	Filter          string  `json:"filter"`
+	Topics          int     `json:"topics"`
+	Subscribers     int     `json:"subscribers"`
+	Expected        int64   `json:"expected"`
+	Received        int64   `json:"received"`
+	TotalMsgsPerSec float64 `json:"total_msgs_per_sec"`
+	MsgTimeAvg      float64 `json:"msg_time_mean_avg"`
+	MsgTimeP99      float64 `json:"msg_time_p99"`
+}
+
+// topicMatches reports whether the topic matches the subscription filter, with the + and # wildcards
+func topicMatches(filter string, topic string) bool {
+	// wildcards at the first level do not match topics starting with $
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// matchingTopics returns the number of topics matched by the filter
+func matchingTopics(filter string, topics []string) int {
+	n := 0
+	for _, topic := range topics {
+		if topicMatches(filter, topic) {
+			n++
+		}
+	}
+	return n
+}
+
+// calculateFanInResults summarizes the results of the subscribers of a single filter
+func calculateFanInResults(filter string, topics int, expected int64, subResults []*SubscriberResults, latencies []uint64) *FanInResults {
+	res := &FanInResults{Filter: filter, Topics: topics}
+	for _, sub := range subResults {
+		res.Subscribers++
+		res.Expected += expected
+		res.Received += sub.Received
+		res.TotalMsgsPerSec += sub.MsgsPerSec
+	}
+	if len(latencies) > 0 {
+		latenciesFloat64 := stats.LoadRawData(latencies)
+		res.MsgTimeAvg, _ = stats.Mean(latenciesFloat64)
+		res.MsgTimeP99, _ = stats.Percentile(latenciesFloat64, 99)
+	}
+	return res
+}
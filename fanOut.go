@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/montanaflynn/stats"
+)
+
+// TopicResults describes the delivery of the messages of a single topic to its subscribers
+type TopicResults struct {
+	Topic       string  `json:"topic"`
+	Subscribers int     `json:"subscribers"`
+	Expected    int64   `json:"expected"`
+	Received    int64   `json:"received"`
+	MsgTimeMin  float64 `json:"msg_time_min"`
+	MsgTimeMax  float64 `json:"msg_time_max"`
+	MsgTimeAvg  float64 `json:"msg_time_mean_avg"`
+	MsgTimeP50  float64 `json:"msg_time_p50"`
+	MsgTimeP99  float64 `json:"msg_time_p99"`
+
+	latencies []float64
+}
+
+// FanOutResults aggregates the topics having the same number of subscribers,
+// showing how the delivery latency grows with the fan-out
+type FanOutResults struct {
+	Subscribers int     `json:"subscribers"`
+	Topics      int     `json:"topics"`
+	Expected    int64   `json:"expected"`
+	Received    int64   `json:"received"`
+	MsgTimeAvg  float64 `json:"msg_time_mean_avg"`
+	MsgTimeP50  float64 `json:"msg_time_p50"`
+	MsgTimeP99  float64 `json:"msg_time_p99"`
+	MsgTimeMax  float64 `json:"msg_time_max"`
+}
+
+// parseFanOut parses a comma separated list of <topic number>:<subscribers>, e.g. "0:5000,3:100"
+func parseFanOut(value string, topicCount int) (map[int]int, error) {
+	fanOut := map[int]int{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		fields := strings.SplitN(s, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid fan-out %q, expected <topic number>:<subscribers>", s)
+		}
+		t, err := strconv.Atoi(fields[0])
+		if err != nil || t < 0 || t >= topicCount {
+			return nil, fmt.Errorf("invalid fan-out topic number %q, topic count is %v", fields[0], topicCount)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid fan-out subscribers %q", fields[1])
+		}
+		fanOut[t] = n
+	}
+	return fanOut, nil
+}
+
+func calculateTopicResults(topic string, expected int64, subResults []*SubscriberResults, latencies []uint64) *TopicResults {
+	res := &TopicResults{Topic: topic, Subscribers: len(subResults), Expected: expected}
+	for _, sub := range subResults {
+		res.Received += sub.Received
+	}
+	if len(latencies) > 0 {
+		res.latencies = stats.LoadRawData(latencies)
+		res.MsgTimeMin, _ = stats.Min(res.latencies)
+		res.MsgTimeMax, _ = stats.Max(res.latencies)
+		res.MsgTimeAvg, _ = stats.Mean(res.latencies)
+		res.MsgTimeP50, _ = stats.Percentile(res.latencies, 50)
+		res.MsgTimeP99, _ = stats.Percentile(res.latencies, 99)
+	}
+	return res
+}
+
+func calculateFanOutResults(topics []*TopicResults) []*FanOutResults {
+	byCount := map[int]*FanOutResults{}
+	latencies := map[int][]float64{}
+	for _, t := range topics {
+		res, ok := byCount[t.Subscribers]
+		if !ok {
+			res = &FanOutResults{Subscribers: t.Subscribers}
+			byCount[t.Subscribers] = res
+		}
+		res.Topics++
+		res.Expected += t.Expected
+		res.Received += t.Received
+		latencies[t.Subscribers] = append(latencies[t.Subscribers], t.latencies...)
+	}
+
+	results := []*FanOutResults{}
+	for n, res := range byCount {
+		if l := latencies[n]; len(l) > 0 {
+			res.MsgTimeAvg, _ = stats.Mean(l)
+			res.MsgTimeP50, _ = stats.Percentile(l, 50)
+			res.MsgTimeP99, _ = stats.Percentile(l, 99)
+			res.MsgTimeMax, _ = stats.Max(l)
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Subscribers < results[j].Subscribers })
+	return results
+}
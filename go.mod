@@ -1,6 +1,7 @@
 module github.com/banzai262/mqtt-benchmark-plus
 
-go 1.18
+// github.com/eugenmayer/go-sshclient v1.2.0 declares go 1.21, which go 1.21+ toolchains require here too
+go 1.21
 
 require (
 	github.com/GaryBoone/GoStats v0.0.0-20130122001700-1993eafbef57
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+)
+
+// headerLen is the size of the header every generated payload starts with:
+// the send timestamp in milliseconds (8 bytes), the publisher key (4 bytes) and the message sequence number (4 bytes)
+const headerLen = 16
+
+// msgHeader describes the metadata carried at the start of a payload
+type msgHeader struct {
+	Sent      uint64
+	Publisher uint32
+	Seq       uint32
+}
+
+// key identifies a message across all publishers
+func (h msgHeader) key() uint64 {
+	return uint64(h.Publisher)<<32 | uint64(h.Seq)
+}
+
+// publisherKey derives the 4 bytes publisher identifier written in the header
+func publisherKey(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32()
+}
+
+func writeHeader(payload []byte, sent time.Time, publisher uint32, seq uint32) {
+	binary.LittleEndian.PutUint64(payload[0:8], uint64(sent.UTC().UnixMilli()))
+	binary.LittleEndian.PutUint32(payload[8:12], publisher)
+	binary.LittleEndian.PutUint32(payload[12:16], seq)
+}
+
+func readHeader(payload []byte) (msgHeader, bool) {
+	if len(payload) < headerLen {
+		return msgHeader{}, false
+	}
+	return msgHeader{
+		Sent:      binary.LittleEndian.Uint64(payload[0:8]),
+		Publisher: binary.LittleEndian.Uint32(payload[8:12]),
+		Seq:       binary.LittleEndian.Uint32(payload[12:16]),
+	}, true
+}
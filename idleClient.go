@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/montanaflynn/stats"
+)
+
+// IdleClient holds a connection open and only sends keepalive pings, like an idle device of a fleet
+type IdleClient struct {
+	ID         string
+	ClientID   string
+	BrokerURL  string
+	BrokerUser string
+	BrokerPass string
+	TLSConfig  *tls.Config
+	KeepAlive  time.Duration
+	Quiet      bool
+
+	mu          sync.Mutex
+	pingSent    time.Time
+	pings       []float64
+	disconnects int64
+}
+
+// IdleClientResults describes results of a single idle client
+type IdleClientResults struct {
+	ID          string
+	Connected   bool
+	Disconnects int64
+	PingTimes   []float64
+}
+
+// IdleResults describes results of all idle clients
+type IdleResults struct {
+	Clients     int64   `json:"clients"`
+	Connected   int64   `json:"connected"`
+	Disconnects int64   `json:"disconnects"`
+	Pings       int64   `json:"pings"`
+	PingTimeMin float64 `json:"ping_time_min"`
+	PingTimeMax float64 `json:"ping_time_max"`
+	PingTimeAvg float64 `json:"ping_time_mean_avg"`
+	PingTimeP99 float64 `json:"ping_time_p99"`
+}
+
+// Run connects the client and keeps it idle until stop is closed
+func (c *IdleClient) Run(stop chan struct{}, res chan *IdleClientResults) {
+	tracker := &ConnTracker{OnPacket: c.onPacket}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.BrokerURL).
+		SetClientID(c.ClientID).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetCustomOpenConnectionFn(tracker.openConnection).
+		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			c.mu.Lock()
+			c.disconnects++
+			c.mu.Unlock()
+			if !c.Quiet {
+				log.Printf("IDLE %v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
+			}
+		})
+	if c.BrokerUser != "" && c.BrokerPass != "" {
+		opts.SetUsername(c.BrokerUser)
+		opts.SetPassword(c.BrokerPass)
+	}
+	if c.TLSConfig != nil {
+		opts.SetTLSConfig(c.TLSConfig)
+	}
+	opts.SetKeepAlive(c.KeepAlive)
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	connected := token.Error() == nil
+	if !connected {
+		log.Printf("IDLE %v had error connecting to the broker: %v\n", c.ID, token.Error())
+	}
+
+	<-stop
+	if connected {
+		client.Disconnect(250)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res <- &IdleClientResults{
+		ID:          c.ID,
+		Connected:   connected,
+		Disconnects: c.disconnects,
+		PingTimes:   c.pings,
+	}
+}
+
+func (c *IdleClient) onPacket(outbound bool, packetType byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case outbound && packetType == packets.Pingreq:
+		c.pingSent = time.Now()
+	case !outbound && packetType == packets.Pingresp && !c.pingSent.IsZero():
+		c.pings = append(c.pings, float64(time.Since(c.pingSent).Microseconds())/1000)
+		c.pingSent = time.Time{}
+	}
+}
+
+func calculateIdleResults(results []*IdleClientResults) *IdleResults {
+	totals := &IdleResults{Clients: int64(len(results))}
+	pings := []float64{}
+	for _, res := range results {
+		if res.Connected {
+			totals.Connected++
+		}
+		totals.Disconnects += res.Disconnects
+		pings = append(pings, res.PingTimes...)
+	}
+	totals.Pings = int64(len(pings))
+	if len(pings) > 0 {
+		totals.PingTimeMin, _ = stats.Min(pings)
+		totals.PingTimeMax, _ = stats.Max(pings)
+		totals.PingTimeAvg, _ = stats.Mean(pings)
+		totals.PingTimeP99, _ = stats.Percentile(pings, 99)
+	}
+	return totals
+}
+
+// startIdleClients starts count idle clients, at most rate per second when rate > 0
+func startIdleClients(count int, rate int, stop chan struct{}, res chan *IdleClientResults, newClient func(i int) *IdleClient) {
+	var ticker *time.Ticker
+	if rate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+	}
+	for i := 0; i < count; i++ {
+		if ticker != nil {
+			<-ticker.C
+		}
+		go newClient(i).Run(stop, res)
+	}
+}
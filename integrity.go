@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+)
+
+var (
+	errTruncated = errors.New("truncated payload")
+	errCorrupted = errors.New("corrupted payload")
+)
+
+// Integrity seals payloads with a trailer holding the length of the sealed payload (4 bytes) and a checksum of
+// everything before it: CRC32 (IEEE, 4 bytes) or XXH64 (8 bytes). Subscribers open the payload before reading it
+type Integrity struct {
+	Algorithm string
+	sumLen    int
+}
+
+func newIntegrity(algorithm string) (*Integrity, error) {
+	switch algorithm {
+	case "", "none":
+		return nil, nil
+	case "crc32":
+		return &Integrity{Algorithm: algorithm, sumLen: 4}, nil
+	case "xxhash":
+		return &Integrity{Algorithm: algorithm, sumLen: 8}, nil
+	}
+	return nil, fmt.Errorf("unknown integrity algorithm %q", algorithm)
+}
+
+func (i *Integrity) trailerLen() int {
+	return 4 + i.sumLen
+}
+
+func (i *Integrity) sum(b []byte, out []byte) {
+	if i.sumLen == 4 {
+		binary.LittleEndian.PutUint32(out, crc32.ChecksumIEEE(b))
+		return
+	}
+	binary.LittleEndian.PutUint64(out, xxh64(b))
+}
+
+// Seal returns a copy of the payload followed by the trailer
+func (i *Integrity) Seal(payload []byte) []byte {
+	n := len(payload) + i.trailerLen()
+	sealed := make([]byte, n)
+	copy(sealed, payload)
+	binary.LittleEndian.PutUint32(sealed[len(payload):], uint32(n))
+	i.sum(sealed[:n-i.sumLen], sealed[n-i.sumLen:])
+	return sealed
+}
+
+// Open verifies a sealed payload and returns it without the trailer
+func (i *Integrity) Open(sealed []byte) ([]byte, error) {
+	n := len(sealed)
+	if n < i.trailerLen() {
+		return nil, errTruncated
+	}
+	if declared := int(binary.LittleEndian.Uint32(sealed[n-i.trailerLen():])); declared != n {
+		if n < declared {
+			return nil, errTruncated
+		}
+		return nil, errCorrupted
+	}
+	var sum [8]byte
+	i.sum(sealed[:n-i.sumLen], sum[:i.sumLen])
+	if string(sum[:i.sumLen]) != string(sealed[n-i.sumLen:]) {
+		return nil, errCorrupted
+	}
+	return sealed[:n-i.trailerLen()], nil
+}
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+func xxhRound(acc, lane uint64) uint64 {
+	return bits.RotateLeft64(acc+lane*xxhPrime2, 31) * xxhPrime1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	return (acc^xxhRound(0, v))*xxhPrime1 + xxhPrime4
+}
+
+// xxh64 is the XXH64 hash of b with a zero seed
+func xxh64(b []byte) uint64 {
+	n := len(b)
+	var h, seed uint64
+	if n >= 32 {
+		v1, v2, v3, v4 := seed+xxhPrime1+xxhPrime2, seed+xxhPrime2, seed, seed-xxhPrime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxhMerge(h, v1)
+		h = xxhMerge(h, v2)
+		h = xxhMerge(h, v3)
+		h = xxhMerge(h, v4)
+	} else {
+		h = seed + xxhPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/montanaflynn/stats"
+)
+
+// LWTBenchmark connects clients registering a will on <topic>/will/<n>, kills their connections without DISCONNECT
+// and measures how fast the subscribers of <topic>/will/+ receive the wills published by the broker
+type LWTBenchmark struct {
+	BrokerURL      string
+	BrokerUser     string
+	BrokerPass     string
+	TLSConfig      *tls.Config
+	Topic          string
+	Clients        int
+	ConnectRate    int // connections per second, 0 opens them as fast as possible
+	KillRate       int // connections killed per second, 0 kills them all at once
+	ConnectTimeout time.Duration
+	Subscribers    int
+	MsgSize        int
+	MsgQoS         byte
+	DelayThreshold time.Duration // wills received later than this after the kill are reported as delayed
+	Timeout        time.Duration // time to wait for the wills after the last kill
+	Quiet          bool
+}
+
+// LWTResults describes results of a will delivery benchmark
+type LWTResults struct {
+	Clients        int              `json:"clients"`
+	Connected      int              `json:"connected"`
+	Killed         int              `json:"killed"`
+	Subscribers    int              `json:"subscribers"`
+	KillTime       float64          `json:"kill_time"`
+	Expected       int64            `json:"expected"`
+	Received       int64            `json:"received"`
+	Missing        int64            `json:"missing"`
+	Delayed        int64            `json:"delayed"`
+	Premature      int64            `json:"premature"`
+	Duplicates     int64            `json:"duplicates"`
+	WillTimeMin    float64          `json:"will_time_min"`
+	WillTimeMax    float64          `json:"will_time_max"`
+	WillTimeAvg    float64          `json:"will_time_mean_avg"`
+	WillTimeP50    float64          `json:"will_time_p50"`
+	WillTimeP99    float64          `json:"will_time_p99"`
+	DelayThreshold float64          `json:"delay_threshold"`
+	FailureReasons map[string]int64 `json:"failure_reasons"`
+}
+
+// willTracker matches the wills received by every subscriber with the time their client was killed
+type willTracker struct {
+	mu         sync.Mutex
+	killedAt   []time.Time
+	seen       [][]bool
+	delays     []float64
+	received   int64
+	expected   int64
+	premature  int64
+	duplicates int64
+}
+
+func (t *willTracker) kill(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.killedAt[i] = time.Now()
+	t.expected += int64(len(t.seen))
+}
+
+func (t *willTracker) will(sub int, topic string) {
+	i, err := strconv.Atoi(topic[strings.LastIndexByte(topic, '/')+1:])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil || i < 0 || i >= len(t.killedAt) {
+		return
+	}
+	switch {
+	case t.killedAt[i].IsZero():
+		// the broker considered the client gone before the benchmark killed it
+		t.premature++
+	case t.seen[sub][i]:
+		t.duplicates++
+	default:
+		t.seen[sub][i] = true
+		t.received++
+		t.delays = append(t.delays, float64(time.Since(t.killedAt[i]).Microseconds())/1000)
+	}
+}
+
+// complete reports whether every will of the killed clients was received
+func (t *willTracker) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.received >= t.expected
+}
+
+// Run subscribes to the wills, connects and kills the clients, then waits for the wills
+func (b *LWTBenchmark) Run() *LWTResults {
+	res := &LWTResults{
+		Clients:        b.Clients,
+		Subscribers:    b.Subscribers,
+		DelayThreshold: float64(b.DelayThreshold.Microseconds()) / 1000,
+		FailureReasons: make(map[string]int64),
+	}
+	runStamp := time.Now().UTC().UnixMilli()
+	tracker := &willTracker{
+		killedAt: make([]time.Time, b.Clients),
+		seen:     make([][]bool, b.Subscribers),
+	}
+
+	filter := b.Topic + "/will/+"
+	subscribers := []mqtt.Client{}
+	for s := 0; s < b.Subscribers; s++ {
+		tracker.seen[s] = make([]bool, b.Clients)
+		client := b.newClient(fmt.Sprintf("subscriber-lwt-%v-%v", s, runStamp), nil, "", nil)
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			log.Fatalf("SUBSCRIBER lwt-%v had error connecting to the broker: %v", s, token.Error())
+		}
+		sub := s
+		token := client.Subscribe(filter, b.MsgQoS, func(c mqtt.Client, m mqtt.Message) {
+			tracker.will(sub, m.Topic())
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Fatalf("SUBSCRIBER lwt-%v had error subscribing to %v: %v", s, filter, token.Error())
+		}
+		subscribers = append(subscribers, client)
+	}
+	defer func() {
+		for _, client := range subscribers {
+			client.Disconnect(250)
+		}
+	}()
+
+	// connect the clients registering their will
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	conns := make([]*ConnTracker, b.Clients)
+	connect := func(i int) {
+		defer wg.Done()
+		clientID := fmt.Sprintf("lwt-%v-%v", i, runStamp)
+		payload := make([]byte, b.MsgSize)
+		if len(payload) < headerLen {
+			payload = make([]byte, headerLen)
+		}
+		writeHeader(payload, time.Now(), publisherKey(clientID), uint32(i))
+		conn := &ConnTracker{}
+		client := b.newClient(clientID, conn, fmt.Sprintf("%v/will/%v", b.Topic, i), payload)
+		token := client.Connect()
+		token.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if token.Error() != nil {
+			res.FailureReasons[token.Error().Error()]++
+			return
+		}
+		res.Connected++
+		conns[i] = conn
+	}
+	var ticker *time.Ticker
+	if b.ConnectRate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(b.ConnectRate))
+	}
+	for i := 0; i < b.Clients; i++ {
+		if ticker != nil {
+			<-ticker.C
+		}
+		wg.Add(1)
+		go connect(i)
+		if !b.Quiet && i > 0 && i%1000 == 0 {
+			log.Printf("Opened %v connections and keeps connecting...\n", i)
+		}
+	}
+	wg.Wait()
+	if ticker != nil {
+		ticker.Stop()
+	}
+
+	// kill the connections without DISCONNECT so the broker publishes the wills
+	if !b.Quiet {
+		log.Printf("Killing %v connections\n", res.Connected)
+	}
+	ticker = nil
+	if b.KillRate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(b.KillRate))
+		defer ticker.Stop()
+	}
+	started := time.Now()
+	for i, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		if ticker != nil {
+			<-ticker.C
+		}
+		tracker.kill(i)
+		if conn.Drop() {
+			res.Killed++
+		}
+	}
+	res.KillTime = time.Since(started).Seconds()
+
+	// the subscribers report every will through the tracker, poll it until complete or timed out
+	timeout := time.After(b.Timeout)
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+wait:
+	for {
+		select {
+		case <-poll.C:
+			if tracker.complete() {
+				break wait
+			}
+		case <-timeout:
+			if !b.Quiet {
+				log.Printf("Timed out waiting for the wills\n")
+			}
+			break wait
+		}
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	res.Expected = tracker.expected
+	res.Received = tracker.received
+	res.Missing = tracker.expected - tracker.received
+	res.Premature = tracker.premature
+	res.Duplicates = tracker.duplicates
+	for _, d := range tracker.delays {
+		if d > res.DelayThreshold {
+			res.Delayed++
+		}
+	}
+	if len(tracker.delays) > 0 {
+		res.WillTimeMin, _ = stats.Min(tracker.delays)
+		res.WillTimeMax, _ = stats.Max(tracker.delays)
+		res.WillTimeAvg, _ = stats.Mean(tracker.delays)
+		res.WillTimeP50, _ = stats.Percentile(tracker.delays, 50)
+		res.WillTimeP99, _ = stats.Percentile(tracker.delays, 99)
+	}
+	return res
+}
+
+// newClient creates a client, tracking its connection and registering its will when conn is set
+func (b *LWTBenchmark) newClient(clientID string, conn *ConnTracker, willTopic string, will []byte) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(clientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectTimeout(b.ConnectTimeout)
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	if conn != nil {
+		opts.SetCustomOpenConnectionFn(conn.openConnection)
+		opts.SetBinaryWill(willTopic, will, b.MsgQoS, false)
+	}
+	opts.SetKeepAlive(0)
+	return mqtt.NewClient(opts)
+}
+
+func printLWTResults(res *LWTResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= LWT (%d clients) =========\n", res.Clients)
+		fmt.Printf("Connected:                   %d\n", res.Connected)
+		fmt.Printf("Killed:                      %d\n", res.Killed)
+		fmt.Printf("Kill time (sec):             %.3f\n", res.KillTime)
+		fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(res.Received)/float64(res.Expected), res.Received, res.Expected)
+		fmt.Printf("Missing wills:               %d\n", res.Missing)
+		fmt.Printf("Delayed wills:               %d (> %.0f ms)\n", res.Delayed, res.DelayThreshold)
+		fmt.Printf("Premature wills:             %d\n", res.Premature)
+		fmt.Printf("Duplicated wills:            %d\n", res.Duplicates)
+		fmt.Printf("Will time min (ms):          %.3f\n", res.WillTimeMin)
+		fmt.Printf("Will time max (ms):          %.3f\n", res.WillTimeMax)
+		fmt.Printf("Will time mean (ms):         %.3f\n", res.WillTimeAvg)
+		fmt.Printf("Will time p50 (ms):          %.3f\n", res.WillTimeP50)
+		fmt.Printf("Will time p99 (ms):          %.3f\n", res.WillTimeP99)
+		printFailureReasons(res.FailureReasons)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/montanaflynn/stats"
@@ -18,23 +19,84 @@ import (
 
 // MessageMqtt describes a message fro mqtt
 type MessageMqtt struct {
-	Topic     string
-	QoS       byte
-	Payload   []byte
-	Sent      time.Time
-	Delivered time.Time
-	Error     bool
+	Topic      string
+	QoS        byte
+	Payload    []byte
+	Sent       time.Time
+	Delivered  time.Time
+	Retained   bool
+	Error      bool
+	AckTimeout bool
 }
 
+// maxRate is the largest rate per second of the tickers pacing the clients, whose period would round to 0 above
+const maxRate = int(time.Second)
+
 // RunResults describes results of a single client / run
 type RunResults struct {
-	ID          string  `json:"id"`
-	Successes   int64   `json:"successes"`
-	Failures    int64   `json:"failures"`
-	RunTime     float64 `json:"run_time"`
-	MsgsPerSec  float64 `json:"msgs_per_sec"`
-	CpuUsage    float64 `json:"cpu_usage`
-	MemoryUsage float64 `json:"memory_usage"`
+	ID             string    `json:"id"`
+	Successes      int64     `json:"successes"`
+	Failures       int64     `json:"failures"`
+	RunTime        float64   `json:"run_time"`
+	MsgsPerSec     float64   `json:"msgs_per_sec"`
+	CpuUsage       float64   `json:"cpu_usage"`
+	MemoryUsage    float64   `json:"memory_usage"`
+	Reconnects     int64     `json:"reconnects"`
+	ReconnectTimes []float64 `json:"reconnect_times,omitempty"`
+	ConnectTime    float64   `json:"connect_time"`
+	SessionPresent bool      `json:"session_present"`
+	ConnectError   string    `json:"connect_error,omitempty"`
+	AckTimeouts    int64     `json:"ack_timeouts"`
+	Bytes          int64     `json:"bytes"`
+	WireBytes      int64     `json:"wire_bytes"`
+	MBPerSec       float64   `json:"mb_per_sec"`
+	WireMBPerSec   float64   `json:"wire_mb_per_sec"`
+	SizeMin        float64   `json:"size_min"`
+	SizeMax        float64   `json:"size_max"`
+	SizeAvg        float64   `json:"size_mean_avg"`
+	Compression    float64   `json:"compression_ratio"`
+	AckLatency
+
+	ackTimes    []float64
+	sizes       []float64
+	compression compressionStats
+}
+
+// AckLatency describes the distribution of the publish-to-ack latency in milliseconds
+type AckLatency struct {
+	AckTimeMin float64 `json:"ack_time_min"`
+	AckTimeMax float64 `json:"ack_time_max"`
+	AckTimeAvg float64 `json:"ack_time_mean_avg"`
+	AckTimeStd float64 `json:"ack_time_mean_std"`
+	AckTimeP50 float64 `json:"ack_time_p50"`
+	AckTimeP95 float64 `json:"ack_time_p95"`
+	AckTimeP99 float64 `json:"ack_time_p99"`
+}
+
+// SubscriberResults describes results of a single subscriber
+type SubscriberResults struct {
+	ID             string    `json:"id"`
+	Topic          string    `json:"topic"`
+	Received       int64     `json:"received"`
+	Duplicates     int64     `json:"duplicates"`
+	Lost           int64     `json:"lost"`
+	MsgsPerSec     float64   `json:"msgs_per_sec"`
+	Reconnects     int64     `json:"reconnects"`
+	ReconnectTimes []float64 `json:"reconnect_times,omitempty"`
+	Group          string    `json:"group,omitempty"`
+	Bytes          int64     `json:"bytes"`
+	WireBytes      int64     `json:"wire_bytes"`
+	MBPerSec       float64   `json:"mb_per_sec"`
+	WireMBPerSec   float64   `json:"wire_mb_per_sec"`
+	DecodeErrors   int64     `json:"decode_errors,omitempty"`
+	DecodeTimeAvg  float64   `json:"decode_time_mean_avg,omitempty"`
+	Corrupted      int64     `json:"corrupted"`
+	Truncated      int64     `json:"truncated"`
+}
+
+// failures counts the messages received damaged or undecodable, which are neither received nor lost
+func (r *SubscriberResults) failures() int64 {
+	return r.Corrupted + r.Truncated + r.DecodeErrors
 }
 
 // TotalResults describes results of all clients / runs
@@ -42,6 +104,9 @@ type TotalResults struct {
 	Ratio                     float64   `json:"ratio"`
 	Successes                 int64     `json:"successes"`
 	Failures                  int64     `json:"failures"`
+	SubscriberRatio           float64   `json:"subscriber_ratio"`
+	SubscriberSuccesses       int64     `json:"subscriber_successes"`
+	SubscriberFailures        int64     `json:"subscriber_failures"`
 	TotalRunTime              float64   `json:"total_run_time"`
 	AvgRunTime                float64   `json:"avg_run_time"`
 	TimeMeasurements          []float64 `json:"time_measurements"`
@@ -49,30 +114,85 @@ type TotalResults struct {
 	MsgTimeMax                float64   `json:"msg_time_max"`
 	MsgTimeAvg                float64   `json:"msg_time_mean_avg"`
 	MsgTimeStd                float64   `json:"msg_time_mean_std"`
+	MsgTimeP50                float64   `json:"msg_time_p50"`
+	MsgTimeP95                float64   `json:"msg_time_p95"`
+	MsgTimeP99                float64   `json:"msg_time_p99"`
 	TotalMsgsPerSecPublisher  float64   `json:"total_msgs_per_sec_pub"`
 	AvgMsgsPerSecPublisher    float64   `json:"avg_msgs_per_sec_pub"`
 	TotalMsgsPerSecSubscriber float64   `json:"total_msgs_per_sec_sub"`
 	AvgMsgsPerSecSubscriber   float64   `json:"avg_msgs_per_sec_sub"`
 	AvgCpuUsage               float64   `json:"avg_cpu_usage"`
 	AvgMemoryUsage            float64   `json:"avg_memory_usage"`
+	Reconnects                int64     `json:"reconnects"`
+	ReconnectTimeMin          float64   `json:"reconnect_time_min"`
+	ReconnectTimeMax          float64   `json:"reconnect_time_max"`
+	ReconnectTimeAvg          float64   `json:"reconnect_time_mean_avg"`
+	MsgsLost                  int64     `json:"msgs_lost"`
+	MsgsDuplicated            int64     `json:"msgs_duplicated"`
+	Topics                    int       `json:"topics"`
+	TopicDepth                int       `json:"topic_depth"`
+	TotalBytes                int64     `json:"total_bytes"`
+	TotalWireBytes            int64     `json:"total_wire_bytes"`
+	TotalBytesSubscriber      int64     `json:"total_bytes_sub"`
+	TotalWireBytesSubscriber  int64     `json:"total_wire_bytes_sub"`
+	TotalMBPerSecPublisher    float64   `json:"total_mb_per_sec_pub"`
+	AvgMBPerSecPublisher      float64   `json:"avg_mb_per_sec_pub"`
+	TotalWireMBPerSecPub      float64   `json:"total_wire_mb_per_sec_pub"`
+	TotalMBPerSecSubscriber   float64   `json:"total_mb_per_sec_sub"`
+	AvgMBPerSecSubscriber     float64   `json:"avg_mb_per_sec_sub"`
+	TotalWireMBPerSecSub      float64   `json:"total_wire_mb_per_sec_sub"`
+	SizeMin                   float64   `json:"size_min"`
+	SizeMax                   float64   `json:"size_max"`
+	SizeAvg                   float64   `json:"size_mean_avg"`
+	SizeStd                   float64   `json:"size_mean_std"`
+	SizeP50                   float64   `json:"size_p50"`
+	SizeP99                   float64   `json:"size_p99"`
+	Compression               float64   `json:"compression_ratio"`
+	Encoding                  string    `json:"encoding,omitempty"`
+	DecodeErrors              int64     `json:"decode_errors,omitempty"`
+	DecodeTimeAvg             float64   `json:"decode_time_mean_avg,omitempty"`
+	Integrity                 string    `json:"integrity,omitempty"`
+	MsgsCorrupted             int64     `json:"msgs_corrupted,omitempty"`
+	MsgsTruncated             int64     `json:"msgs_truncated,omitempty"`
+	AckLatency
 }
 
 // JSONResults are used to export results as a JSON document
 type JSONResults struct {
-	Runs   []*RunResults `json:"runs"`
-	Totals *TotalResults `json:"totals"`
+	Runs        []*RunResults        `json:"runs"`
+	Subscribers []*SubscriberResults `json:"subscribers"`
+	Groups      []*ShareGroupResults `json:"share_groups,omitempty"`
+	FanIn       []*FanInResults      `json:"fan_in,omitempty"`
+	Topics      []*TopicResults      `json:"topics,omitempty"`
+	FanOut      []*FanOutResults     `json:"fan_out,omitempty"`
+	Idle        *IdleResults         `json:"idle,omitempty"`
+	Verify      *VerifyResults       `json:"verify,omitempty"`
+	Totals      *TotalResults        `json:"totals"`
 }
 
 func main() {
 	var (
+		mode                = flag.String("mode", "pubsub", "Benchmark mode: pubsub|connect|churn|retained|lwt|backlog|rpc|record|replay|sparkplug|devices")
 		broker              = flag.String("broker", "tcp://localhost:1883", "MQTT broker endpoint as scheme://host:port")
 		topic               = flag.String("topic", "/test", "MQTT topic for outgoing messages")
-		payload             = flag.String("payload", "", "MQTT message payload. If empty, then payload is generated based on the size parameter")
+		topicTemplate       = flag.String("topic-template", "", "Template of the topic tree, e.g. site/{1..10}/device/{1..100}/sensor/{temp|hum}, replaces -topic")
+		payload             = flag.String("payload", "", "MQTT message payload, sent after the header. If empty, then payload is generated based on the size parameter")
+		payloadTemplate     = flag.String("payload-template", "", "Template rendered for every message payload, e.g. {\"temp\":{{randFloat 10 30}}}, or @file to read it from a file")
+		payloadCorpus       = flag.String("payload-corpus", "", "Captured payloads to replay: a directory of files, a newline-delimited file or a JSONL file (.jsonl)")
+		payloadOrder        = flag.String("payload-order", "cycle", "Order of the corpus payloads: cycle|random")
+		payloadContent      = flag.String("payload-content", "zeros", "Content of generated payloads: zeros|random|text")
+		payloadEntropy      = flag.Float64("payload-entropy", 4, "Bits of entropy per character of text payloads, from 0 (one repeated character) to 6.6")
+		integrity           = flag.String("integrity", "none", "Payload integrity check: none|crc32|xxhash, publishers append the length and checksum that subscribers verify")
+		encodingName        = flag.String("encoding", "raw", "Payload encoding: raw|json|cbor|msgpack|protobuf, the latency metadata is then carried inside the message")
+		protoDescriptor     = flag.String("proto-descriptor", "", "FileDescriptorSet of the protobuf encoding, as written by protoc --descriptor_set_out")
+		protoMessage        = flag.String("proto-message", "", "Fully qualified name of the protobuf message, e.g. telemetry.Reading")
+		payloadHeader       = flag.Bool("payload-header", true, "Write the 16 bytes header in front of templated, corpus or -payload payloads, needed to measure latency and detect duplicates")
 		username            = flag.String("username", "", "MQTT client username (empty if auth disabled)")
 		password            = flag.String("password", "", "MQTT client password (empty if auth disabled)")
 		qos                 = flag.Int("qos", 1, "QoS for published messages")
-		wait                = flag.Int("wait", 60000, "QoS 1 wait timeout in milliseconds")
+		wait                = flag.Int("wait", 60000, "QoS 1 and 2 acknowledgement wait timeout in milliseconds")
 		size                = flag.Int("size", 0, "Size of the messages payload (bytes)") // previous default value was 100
+		sizeDist            = flag.String("size-dist", "", "Semicolon separated payload size distributions assigned to the publishers in turn, e.g. lognormal:1000,2000, replaces -size")
 		count               = flag.Int("count", 100, "Number of messages to send per client")
 		topicCount          = flag.Int("topic-count", 10, "Number of topic to publish messages on (Default: 10)")
 		publishersPerTopic  = flag.Int("publishers", 1, "Number of publishers per topic to start (Default: 1 per topic)")
@@ -88,6 +208,41 @@ func main() {
 		messageInterval = flag.Int("message-interval", 1000, "Time interval in milliseconds to publish message")
 		remoteUser      = flag.String("remote-user", "", "Username of the remote host where the broker is running")
 		remotePwd       = flag.String("remote-pwd", "", "Password of the remote host where the broker is running")
+		dropAt          = flag.String("drop-at", "", "Comma separated times since start at which every client connection is dropped, e.g. 10s,30s")
+		cleanSession    = flag.Bool("clean-session", true, "Use clean sessions, set to false to test persistent session redelivery")
+		connections     = flag.Int("connections", 1000, "Number of connections to open in connect and lwt modes")
+		connectRate     = flag.Int("connect-rate", 0, "Connections opened per second in connect and lwt modes and by idle clients, devices started per second in devices mode, 0 opens them as fast as possible")
+		connectTimeout  = flag.Int("connect-timeout", 30, "Connect timeout in seconds")
+		holdTime        = flag.Int("hold", 0, "Time in seconds to hold the connections idle in connect mode to measure memory per connection")
+		keepAlive       = flag.Int("keepalive", 0, "Keepalive interval in seconds of publishers and subscribers, 0 disables pings")
+		idleClients     = flag.Int("idle-clients", 0, "Number of idle clients kept connected alongside publishers and subscribers")
+		idleKeepAlive   = flag.Int("idle-keepalive", 30, "Keepalive interval in seconds of idle clients")
+		churnRate       = flag.Int("churn-rate", 10, "Short lived publishers started per second in churn mode")
+		churnDuration   = flag.Int("churn-duration", 60, "Time in seconds during which churn mode starts publishers")
+		shareGroup      = flag.String("share-group", "", "Shared subscription group name, subscribers of a topic then share its messages through $share/<group>/<topic>")
+		fanOut          = flag.String("fan-out", "", "Comma separated <topic number>:<subscribers> overriding the number of subscribers of single topics, e.g. 0:5000")
+		fanInFilters    = flag.String("fan-in-filters", "", "Comma separated wildcard filters, each subscribed by fan-in subscribers aggregating the topics it matches")
+		fanInSubs       = flag.Int("fan-in-subscribers", 1, "Number of subscribers per fan-in filter")
+		retainedUpdates = flag.Int("retained-updates", 2, "Number of values published on each topic in retained mode, subscribers must get the last one")
+		killRate        = flag.Int("kill-rate", 0, "Connections killed per second in lwt mode, 0 kills them all at once")
+		willDelay       = flag.Int("will-delay", 1000, "Time in milliseconds after the kill above which a will is reported as delayed in lwt mode")
+		inflight        = flag.Int("inflight", 0, "Publish asynchronously with at most this many unacknowledged messages per publisher, acknowledged within -wait")
+		verify          = flag.Bool("verify", false, "Wait for the PUBACK/PUBCOMP of every message within -wait and verify the QoS delivery guarantee on the subscribers")
+		responders      = flag.Int("responders", 1, "Number of responder clients answering the requests in rpc mode")
+		backlog         = flag.Int("backlog", 1000, "Number of messages queued for the offline subscribers in backlog mode")
+		recordFile      = flag.String("record-file", "traffic.mqrec", "Recording written by record mode and reproduced by replay mode")
+		recordFilters   = flag.String("record-filters", "#", "Comma separated topic filters recorded in record mode, subscribed to (remapped) by the subscribers in replay mode")
+		recordDuration  = flag.Int("record-duration", 60, "Time in seconds to record in record mode, interrupt to stop earlier")
+		replaySpeed     = flag.Float64("replay-speed", 1, "Replay speed factor in replay mode, e.g. 10 replays 10x faster, 0 as fast as possible")
+		topicRemap      = flag.String("topic-remap", "", "Comma separated from=to topic prefix replacements applied in replay mode, e.g. plant/=bench/plant/")
+		sparkplugGroup  = flag.String("sparkplug-group", "bench", "Sparkplug B group id of the edge nodes in sparkplug mode")
+		edgeNodes       = flag.Int("edge-nodes", 10, "Number of Sparkplug B edge nodes in sparkplug mode")
+		nodeDevices     = flag.Int("node-devices", 5, "Number of devices per edge node in sparkplug mode")
+		deviceMetrics   = flag.Int("device-metrics", 10, "Number of metrics per device in sparkplug mode")
+		devices         = flag.Int("devices", 0, "Number of distinct client ids reused by churn mode publishers, 0 gives every publisher its own")
+		fleetSize       = flag.Int("fleet-size", 100, "Number of devices started in devices mode, each opening a second connection for its commands when its profile has some")
+		deviceProfiles  = flag.String("device-profiles", "", "JSON file of device profiles adding to or overriding the built-in thermostat, gateway and tracker profiles")
+		deviceMix       = flag.String("device-mix", "thermostat:70,gateway:10,tracker:20", "Comma separated <profile>:<weight> mix of the devices started in devices mode")
 	)
 
 	flag.Parse()
@@ -104,14 +259,39 @@ func main() {
 		log.Fatalf("Invalid arguments: number of publishers should be >= 1, given: %v", *publishersPerTopic)
 	}
 
-	if *subscribersPerTopic < 1 {
-		log.Fatalf("Invalid arguments: number of subscribers should be >= 1, given: %v", *subscribersPerTopic)
+	filters := []string{}
+	for _, f := range strings.Split(*fanInFilters, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			filters = append(filters, f)
+		}
+	}
+
+	if *inflight < 0 {
+		log.Fatalf("Invalid arguments: inflight should be >= 0, given: %v", *inflight)
+	}
+	if *subscribersPerTopic < 0 {
+		log.Fatalf("Invalid arguments: number of subscribers should be >= 0, given: %v", *subscribersPerTopic)
 	}
 
 	if *count < 1 {
 		log.Fatalf("Invalid arguments: messages count should be > 1, given: %v", *count)
 	}
 
+	if *connectRate < 0 || *connectRate > maxRate {
+		log.Fatalf("Invalid arguments: connect rate should be between 0 and %v, given: %v", maxRate, *connectRate)
+	}
+
+	fanOutSubs, err := parseFanOut(*fanOut, *topicCount)
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	subscribersFor := func(t int) int {
+		if n, ok := fanOutSubs[t]; ok {
+			return n
+		}
+		return *subscribersPerTopic
+	}
+
 	if *clientCert != "" && *clientKey == "" {
 		log.Fatal("Invalid arguments: private clientKey path missing")
 	}
@@ -120,13 +300,499 @@ func main() {
 		log.Fatalf("Invalid arguments: certificate path missing")
 	}
 
+	if *size != 0 && *size < headerLen {
+		log.Fatalf("Invalid arguments: message size should be >= %v, given: %v", headerLen, *size)
+	}
+
+	dropTimes, err := parseDropTimes(*dropAt)
+	if err != nil {
+		log.Fatalf("Invalid arguments: drop-at should be a list of durations, given: %v", *dropAt)
+	}
+
+	sizeDists, err := parseSizeDistributions(*sizeDist)
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	// sizeDistFor returns the size distribution of the n-th publisher, nil when the size is -size
+	sizeDistFor := func(n int) *SizeDistribution {
+		if len(sizeDists) == 0 {
+			return nil
+		}
+		return sizeDists[n%len(sizeDists)]
+	}
+
+	template, err := readPayloadTemplate(*payloadTemplate)
+	if err != nil {
+		log.Fatalf("Invalid arguments: cannot read payload template: %v", err)
+	}
+	if template != "" {
+		p, err := newPayloadTemplate(template, "check")
+		if err == nil {
+			_, err = p.Generate(0, time.Now())
+		}
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+	}
+	sources := 0
+	for _, set := range []bool{template != "", *payloadCorpus != "", *payload != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		log.Fatalf("Invalid arguments: -payload, -payload-template and -payload-corpus are mutually exclusive")
+	}
+	if *payloadOrder != "cycle" && *payloadOrder != "random" {
+		log.Fatalf("Invalid arguments: payload order should be cycle or random, given: %v", *payloadOrder)
+	}
+	var corpus *PayloadCorpus
+	if *payloadCorpus != "" {
+		corpus, err = loadPayloadCorpus(*payloadCorpus)
+		if err != nil {
+			log.Fatalf("Invalid arguments: cannot load payload corpus: %v", err)
+		}
+	} else if *payload != "" {
+		corpus = newFixedPayload(*payload)
+	}
+	if corpus != nil {
+		corpus.Random = *payloadOrder == "random"
+	}
+	// newPayload returns the payload generator of a publisher, nil when payloads are MsgSize zero bytes
+	newPayload := func(clientID string) PayloadGenerator {
+		if corpus != nil {
+			return corpus.generator(clientID)
+		}
+		if template == "" {
+			return nil
+		}
+		p, _ := newPayloadTemplate(template, clientID)
+		return p
+	}
+	noHeader := (template != "" || corpus != nil) && !*payloadHeader
+	content, err := newPayloadContent(*payloadContent, *payloadEntropy)
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	sealer, err := newIntegrity(*integrity)
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	encoding, err := newPayloadEncoding(*encodingName, *protoDescriptor, *protoMessage)
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	if encoding != nil {
+		// the metadata is inside the message
+		noHeader = false
+	}
+	if *verify && !*payloadHeader && encoding == nil {
+		// without header, duplicates and losses cannot be told apart
+		log.Fatalf("Invalid arguments: -verify needs the payload header, -payload-header=false is not supported")
+	}
+
 	var tlsConfig *tls.Config
 	if *clientCert != "" && *clientKey != "" {
 		tlsConfig = generateTLSConfig(*clientCert, *clientKey, *brokerCaCert, *insecure)
 	}
 
+	switch *mode {
+	case "pubsub":
+	case "connect":
+		if *connections < 1 {
+			log.Fatalf("Invalid arguments: number of connections should be >= 1, given: %v", *connections)
+		}
+		monitor := newResourceMonitor(*broker, remote, *remoteUser, *remotePwd)
+		defer monitor.Close()
+		b := &ConnectBenchmark{
+			BrokerURL:      *broker,
+			BrokerUser:     *username,
+			BrokerPass:     *password,
+			TLSConfig:      tlsConfig,
+			Connections:    *connections,
+			Rate:           *connectRate,
+			ConnectTimeout: time.Duration(*connectTimeout) * time.Second,
+			Hold:           time.Duration(*holdTime) * time.Second,
+			Quiet:          *quiet,
+			Monitor:        monitor,
+		}
+		printConnectResults(b.Run(), *format)
+		return
+	case "churn":
+		if *churnRate < 1 || *churnRate > maxRate {
+			log.Fatalf("Invalid arguments: churn rate should be between 1 and %v, given: %v", maxRate, *churnRate)
+		}
+		runStamp := time.Now().UTC().UnixMilli()
+		g := &ChurnGenerator{
+			Rate:     *churnRate,
+			Duration: time.Duration(*churnDuration) * time.Second,
+			Quiet:    *quiet,
+		}
+		if g.Cycles() < 1 {
+			log.Fatalf("Invalid arguments: churn duration too short for the churn rate, given: %v", *churnDuration)
+		}
+		churnTopic := *topic + "-churn"
+		g.NewPublisher = func(cycle int) *PublisherClient {
+			device := cycle
+			if *devices > 0 {
+				device = cycle % *devices
+			}
+			clientID := fmt.Sprintf("churn-%v-%v", device, runStamp)
+			return &PublisherClient{
+				ID:              fmt.Sprintf("churn-%v", cycle),
+				ClientID:        clientID,
+				BrokerURL:       *broker,
+				BrokerUser:      *username,
+				BrokerPass:      *password,
+				MsgTopic:        churnTopic,
+				MsgSize:         *size,
+				MsgCount:        *count,
+				MsgQoS:          byte(*qos),
+				Quiet:           *quiet,
+				WaitTimeout:     time.Duration(*wait) * time.Millisecond,
+				TLSConfig:       tlsConfig,
+				MessageInterval: *messageInterval,
+				CleanSession:    *cleanSession,
+				KeepAlive:       time.Duration(*keepAlive) * time.Second,
+				Disconnect:      true,
+				SizeDist:        sizeDistFor(cycle),
+				Payload:         newPayload(clientID),
+				NoHeader:        noHeader,
+				Encoding:        encoding,
+				Content:         content,
+				Integrity:       sealer,
+			}
+		}
+
+		subResCh := make(chan *SubscriberResults)
+		latencies := []uint64{}
+		subscribed := &sync.WaitGroup{}
+		sub := &SubscriberClient{
+			ID:            "churn",
+			ClientID:      fmt.Sprintf("subscriber-churn-%v", runStamp),
+			BrokerURL:     *broker,
+			BrokerUser:    *username,
+			BrokerPass:    *password,
+			MsgTopic:      churnTopic,
+			TopicMsgCount: g.Cycles() * *count,
+			MsgQoS:        byte(*qos),
+			TLSConfig:     tlsConfig,
+			Quiet:         *quiet,
+			Timeout:       15,
+			CleanSession:  true,
+			Ready:         subscribed,
+			NoHeader:      noHeader,
+			Decoder:       encoding,
+			Integrity:     sealer,
+		}
+		subscribed.Add(1)
+		go sub.Run(subResCh, &latencies)
+		// the first publisher starts once the subscription is acknowledged
+		subscribed.Wait()
+
+		started := time.Now()
+		results := g.Run()
+		runTime := time.Since(started)
+		subRes := <-subResCh
+		printChurnResults(calculateChurnResults(results, subRes, latencies, runTime), *format)
+		return
+	case "retained":
+		if *retainedUpdates < 1 {
+			log.Fatalf("Invalid arguments: retained updates should be >= 1, given: %v", *retainedUpdates)
+		}
+		topics := make([]string, *topicCount)
+		for t := range topics {
+			topics[t] = *topic + "/" + strconv.Itoa(t)
+		}
+		if *topicTemplate != "" {
+			tmpl, err := parseTopicTemplate(*topicTemplate)
+			if err != nil {
+				log.Fatalf("Invalid arguments: %v", err)
+			}
+			if tmpl.HasClient() {
+				log.Fatalf("Invalid arguments: %v is not supported in retained mode", clientPlaceholder)
+			}
+			if topics, err = tmpl.Expand(*topicCount); err != nil {
+				log.Fatalf("Invalid arguments: %v", err)
+			}
+		}
+		b := &RetainedBenchmark{
+			BrokerURL:   *broker,
+			BrokerUser:  *username,
+			BrokerPass:  *password,
+			TLSConfig:   tlsConfig,
+			Topics:      topics,
+			Filter:      retainedFilter(topics),
+			Updates:     *retainedUpdates,
+			Subscribers: *subscribersPerTopic,
+			MsgSize:     *size,
+			MsgQoS:      byte(*qos),
+			Timeout:     15 * time.Second,
+			WaitTimeout: time.Duration(*wait) * time.Millisecond,
+			Quiet:       *quiet,
+		}
+		if !*quiet {
+			log.Printf("Retained subscribers subscribe to %v\n", b.Filter)
+		}
+		printRetainedResults(b.Run(), *format)
+		return
+	case "lwt":
+		if *connections < 1 {
+			log.Fatalf("Invalid arguments: number of connections should be >= 1, given: %v", *connections)
+		}
+		if *subscribersPerTopic < 1 {
+			log.Fatalf("Invalid arguments: number of subscribers should be >= 1 in lwt mode, given: %v", *subscribersPerTopic)
+		}
+		if *killRate < 0 || *killRate > maxRate {
+			log.Fatalf("Invalid arguments: kill rate should be between 0 and %v, given: %v", maxRate, *killRate)
+		}
+		b := &LWTBenchmark{
+			BrokerURL:      *broker,
+			BrokerUser:     *username,
+			BrokerPass:     *password,
+			TLSConfig:      tlsConfig,
+			Topic:          *topic,
+			Clients:        *connections,
+			ConnectRate:    *connectRate,
+			KillRate:       *killRate,
+			ConnectTimeout: time.Duration(*connectTimeout) * time.Second,
+			Subscribers:    *subscribersPerTopic,
+			MsgSize:        *size,
+			MsgQoS:         byte(*qos),
+			DelayThreshold: time.Duration(*willDelay) * time.Millisecond,
+			Timeout:        15 * time.Second,
+			Quiet:          *quiet,
+		}
+		printLWTResults(b.Run(), *format)
+		return
+	case "backlog":
+		if *backlog < 1 {
+			log.Fatalf("Invalid arguments: backlog should be >= 1, given: %v", *backlog)
+		}
+		if *qos < 1 {
+			log.Fatalf("Invalid arguments: brokers only queue QoS 1 and 2 messages for offline subscribers, given qos: %v", *qos)
+		}
+		if *subscribersPerTopic < 1 {
+			log.Fatalf("Invalid arguments: number of subscribers should be >= 1 in backlog mode, given: %v", *subscribersPerTopic)
+		}
+		b := &BacklogBenchmark{
+			BrokerURL:   *broker,
+			BrokerUser:  *username,
+			BrokerPass:  *password,
+			TLSConfig:   tlsConfig,
+			Topic:       *topic + "-backlog",
+			Backlog:     *backlog,
+			Subscribers: *subscribersPerTopic,
+			MsgSize:     *size,
+			MsgQoS:      byte(*qos),
+			Timeout:     15 * time.Second,
+			WaitTimeout: time.Duration(*wait) * time.Millisecond,
+			Quiet:       *quiet,
+		}
+		printBacklogResults(b.Run(), *format)
+		return
+	case "rpc":
+		if *responders < 1 {
+			log.Fatalf("Invalid arguments: number of responders should be >= 1, given: %v", *responders)
+		}
+		if *publishersPerTopic < 1 {
+			log.Fatalf("Invalid arguments: number of requesters (-publishers) should be >= 1, given: %v", *publishersPerTopic)
+		}
+		window := *inflight
+		if window < 1 {
+			window = 1
+		}
+		b := &RPCBenchmark{
+			BrokerURL:  *broker,
+			BrokerUser: *username,
+			BrokerPass: *password,
+			TLSConfig:  tlsConfig,
+			Topic:      *topic,
+			Requesters: *publishersPerTopic,
+			Responders: *responders,
+			Requests:   *count,
+			Inflight:   window,
+			Interval:   time.Duration(*messageInterval) * time.Millisecond,
+			MsgSize:    *size,
+			MsgQoS:     byte(*qos),
+			Timeout:    time.Duration(*wait) * time.Millisecond,
+			Quiet:      *quiet,
+		}
+		printRPCResults(b.Run(), *format)
+		return
+	case "record":
+		if *recordDuration < 1 {
+			log.Fatalf("Invalid arguments: record duration should be >= 1, given: %v", *recordDuration)
+		}
+		recordFilterList := []string{}
+		for _, f := range strings.Split(*recordFilters, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				recordFilterList = append(recordFilterList, f)
+			}
+		}
+		if len(recordFilterList) == 0 {
+			log.Fatal("Invalid arguments: no filter to record")
+		}
+		b := &RecordBenchmark{
+			BrokerURL:  *broker,
+			BrokerUser: *username,
+			BrokerPass: *password,
+			TLSConfig:  tlsConfig,
+			Filters:    recordFilterList,
+			MsgQoS:     byte(*qos),
+			Path:       *recordFile,
+			Duration:   time.Duration(*recordDuration) * time.Second,
+			Quiet:      *quiet,
+		}
+		printRecordResults(b.Run(), *format)
+		return
+	case "replay":
+		if *replaySpeed < 0 {
+			log.Fatalf("Invalid arguments: replay speed should be >= 0, given: %v", *replaySpeed)
+		}
+		remap, err := parseTopicRemap(*topicRemap)
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		recording, err := readRecording(*recordFile)
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		if len(recording) == 0 {
+			log.Fatalf("Invalid arguments: %v has no message", *recordFile)
+		}
+		filters := []string{}
+		for _, f := range strings.Split(*recordFilters, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				filters = append(filters, f)
+			}
+		}
+		b := &ReplayBenchmark{
+			BrokerURL:   *broker,
+			BrokerUser:  *username,
+			BrokerPass:  *password,
+			TLSConfig:   tlsConfig,
+			Recording:   recording,
+			Remap:       remap,
+			Filters:     filters,
+			Publishers:  *publishersPerTopic,
+			Subscribers: *subscribersPerTopic,
+			Speed:       *replaySpeed,
+			MsgQoS:      byte(*qos),
+			WaitTimeout: time.Duration(*wait) * time.Millisecond,
+			KeepAlive:   time.Duration(*keepAlive) * time.Second,
+			Verify:      *verify,
+			Inflight:    *inflight,
+			NoHeader:    !*payloadHeader,
+			Integrity:   sealer,
+			Remote:      remote,
+			RemoteUser:  *remoteUser,
+			RemotePwd:   *remotePwd,
+			Quiet:       *quiet,
+		}
+		printResults(b.Run(), *format)
+		return
+	case "sparkplug":
+		if *edgeNodes < 1 {
+			log.Fatalf("Invalid arguments: number of edge nodes should be >= 1, given: %v", *edgeNodes)
+		}
+		if *nodeDevices < 0 {
+			log.Fatalf("Invalid arguments: number of devices per edge node should be >= 0, given: %v", *nodeDevices)
+		}
+		if *deviceMetrics < 1 {
+			log.Fatalf("Invalid arguments: number of metrics per device should be >= 1, given: %v", *deviceMetrics)
+		}
+		if *subscribersPerTopic < 1 {
+			log.Fatalf("Invalid arguments: number of host applications (-subscribers) should be >= 1, given: %v", *subscribersPerTopic)
+		}
+		b := &SparkplugBenchmark{
+			BrokerURL:  *broker,
+			BrokerUser: *username,
+			BrokerPass: *password,
+			TLSConfig:  tlsConfig,
+			Group:      *sparkplugGroup,
+			EdgeNodes:  *edgeNodes,
+			Devices:    *nodeDevices,
+			Metrics:    *deviceMetrics,
+			Messages:   *count,
+			Interval:   time.Duration(*messageInterval) * time.Millisecond,
+			Hosts:      *subscribersPerTopic,
+			Timeout:    15 * time.Second,
+			Quiet:      *quiet,
+		}
+		printSparkplugResults(b.Run(), *format)
+		return
+	case "devices":
+		if *fleetSize < 1 {
+			log.Fatalf("Invalid arguments: fleet size should be >= 1, given: %v", *fleetSize)
+		}
+		if *subscribersPerTopic < 1 {
+			log.Fatalf("Invalid arguments: number of backend subscribers (-subscribers) should be >= 1, given: %v", *subscribersPerTopic)
+		}
+		profiles, err := loadDeviceProfiles(*deviceProfiles)
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		mix, err := parseDeviceMix(*deviceMix, profiles)
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		for _, m := range mix {
+			if err := m.First.check(m.First.Name + "-0"); err != nil {
+				log.Fatalf("Invalid arguments: %v", err)
+			}
+		}
+		b := &DeviceFleet{
+			BrokerURL:       *broker,
+			BrokerUser:      *username,
+			BrokerPass:      *password,
+			TLSConfig:       tlsConfig,
+			Mix:             mix,
+			Devices:         *fleetSize,
+			Subscribers:     *subscribersPerTopic,
+			MsgCount:        *count,
+			MsgSize:         *size,
+			MsgQoS:          byte(*qos),
+			MessageInterval: *messageInterval,
+			ConnectRate:     *connectRate,
+			WaitTimeout:     time.Duration(*wait) * time.Millisecond,
+			KeepAlive:       time.Duration(*keepAlive) * time.Second,
+			CleanSession:    *cleanSession,
+			Verify:          *verify,
+			Inflight:        *inflight,
+			NoHeader:        !*payloadHeader,
+			Encoding:        encoding,
+			EncodingName:    *encodingName,
+			Content:         content,
+			Integrity:       sealer,
+			Remote:          remote,
+			RemoteUser:      *remoteUser,
+			RemotePwd:       *remotePwd,
+			Quiet:           *quiet,
+		}
+		printDeviceFleetResults(b.Run(), *format)
+		return
+	default:
+		log.Fatalf("Invalid arguments: unknown mode %v", *mode)
+	}
+
 	resCh := make(chan *RunResults)
-	subTpChannel := make(chan float64)
+	subResCh := make(chan *SubscriberResults)
+
+	idleStop := make(chan struct{})
+	idleResCh := make(chan *IdleClientResults)
+	go startIdleClients(*idleClients, *connectRate, idleStop, idleResCh, func(i int) *IdleClient {
+		return &IdleClient{
+			ID:         strconv.Itoa(i),
+			ClientID:   fmt.Sprintf("idle-%v-%v", i, time.Now().UTC().UnixMilli()),
+			BrokerURL:  *broker,
+			BrokerUser: *username,
+			BrokerPass: *password,
+			TLSConfig:  tlsConfig,
+			KeepAlive:  time.Duration(*idleKeepAlive) * time.Second,
+			Quiet:      *quiet,
+		}
+	})
 
 	latencies := []uint64{}
 	time.Sleep(time.Duration(time.Second * 5))
@@ -135,9 +801,51 @@ func main() {
 	sleepTime := float64(*rampUpTimeInSec) / float64(*publishersPerTopic)
 
 	latenciesPointers := []*[]uint64{}
+	trackers := []*ConnTracker{}
+	newTracker := func() *ConnTracker {
+		if len(dropTimes) == 0 {
+			return nil
+		}
+		t := &ConnTracker{}
+		trackers = append(trackers, t)
+		return t
+	}
 
+	topics := make([]string, *topicCount)
+	topicDepth := len(strings.Split(*topic, "/"))
+	for t := range topics {
+		topics[t] = *topic + "-" + strconv.Itoa(t)
+	}
+	if *topicTemplate != "" {
+		tmpl, err := parseTopicTemplate(*topicTemplate)
+		if err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		if topics, err = tmpl.Expand(*topicCount); err != nil {
+			log.Fatalf("Invalid arguments: %v", err)
+		}
+		topicDepth = tmpl.Depth()
+	}
+	// every publisher of a topic replaces {client} by its number, the subscribers of the topic get them all
+	published := []string{}
+	for t := range topics {
+		for i := 0; i < *publishersPerTopic; i++ {
+			published = append(published, clientTopic(topics[t], strconv.Itoa(i)))
+		}
+	}
+
+	subscribed := &sync.WaitGroup{}
+	groups := []*ShareGroup{}
+	topicIDs := map[string]int{}
+	topicLatencies := make([][]*[]uint64, *topicCount)
+	subscriberCount := 0
 	for t := 0; t < *topicCount; t++ {
-		for i := 0; i < *subscribersPerTopic; i++ {
+		var group *ShareGroup
+		if *shareGroup != "" {
+			group = newShareGroup(*shareGroup, clientTopic(topics[t], "+"), *publishersPerTopic**count)
+			groups = append(groups, group)
+		}
+		for i := 0; i < subscribersFor(t); i++ {
 			array := []uint64{}
 			if !*quiet {
 				log.Println("Starting SUBSCRIBER", fmt.Sprintf("%v-%v", t, i))
@@ -148,32 +856,91 @@ func main() {
 				BrokerURL:     *broker,
 				BrokerUser:    *username,
 				BrokerPass:    *password,
-				MsgTopic:      *topic + "-" + strconv.Itoa(t),
+				MsgTopic:      clientTopic(topics[t], "+"),
 				TopicMsgCount: *publishersPerTopic * *count,
 				MsgQoS:        byte(*qos),
 				TLSConfig:     tlsConfig,
 				Quiet:         *quiet,
 				Timeout:       15,
+				CleanSession:  *cleanSession,
+				Conn:          newTracker(),
+				KeepAlive:     time.Duration(*keepAlive) * time.Second,
+				Group:         group,
+				Ready:         subscribed,
+				NoHeader:      noHeader,
+				Decoder:       encoding,
+				Integrity:     sealer,
 			}
+			topicIDs[c.ID] = t
+			topicLatencies[t] = append(topicLatencies[t], &array)
+			subscriberCount++
 			latenciesPointers = append(latenciesPointers, &array)
-			go c.Run(subTpChannel, &array)
+			subscribed.Add(1)
+			go c.Run(subResCh, &array)
 			time.Sleep(time.Duration(sleepTime*1000) * time.Millisecond)
 		}
 	}
 
+	fanInIDs := map[string]string{}
+	fanInLatencies := map[string][]*[]uint64{}
+	for f, filter := range filters {
+		expected := matchingTopics(filter, published) * *count
+		if expected == 0 {
+			log.Fatalf("Invalid arguments: fan-in filter %v matches no topic", filter)
+		}
+		for i := 0; i < *fanInSubs; i++ {
+			array := []uint64{}
+			id := fmt.Sprintf("fanin-%v-%v", f, i)
+			if !*quiet {
+				log.Println("Starting FAN-IN SUBSCRIBER", id, "on", filter)
+			}
+			c := &SubscriberClient{
+				ID:            id,
+				ClientID:      fmt.Sprintf("subscriber-%v-%v", id, time.Now().UTC().UnixMilli()),
+				BrokerURL:     *broker,
+				BrokerUser:    *username,
+				BrokerPass:    *password,
+				MsgTopic:      filter,
+				TopicMsgCount: expected,
+				MsgQoS:        byte(*qos),
+				TLSConfig:     tlsConfig,
+				Quiet:         *quiet,
+				Timeout:       15,
+				CleanSession:  *cleanSession,
+				Conn:          newTracker(),
+				KeepAlive:     time.Duration(*keepAlive) * time.Second,
+				Ready:         subscribed,
+				NoHeader:      noHeader,
+				Decoder:       encoding,
+				Integrity:     sealer,
+			}
+			fanInIDs[id] = filter
+			fanInLatencies[filter] = append(fanInLatencies[filter], &array)
+			latenciesPointers = append(latenciesPointers, &array)
+			subscribed.Add(1)
+			go c.Run(subResCh, &array)
+		}
+	}
+	subscriberCount += len(filters) * *fanInSubs
+	if subscriberCount == 0 {
+		log.Fatal("Invalid arguments: no subscriber to start")
+	}
+	// publish only once every subscription is in place
+	subscribed.Wait()
+
 	for t := 0; t < *topicCount; t++ {
 		for i := 0; i < *publishersPerTopic; i++ {
 			if !*quiet {
 				log.Println("Starting PUBLISHER", fmt.Sprintf("%v-%v", t, i))
 			}
+			clientID := fmt.Sprintf("publisher-%v-%v-%v", t, i, time.Now().UTC().UnixMilli()) // mqtt-benchmark-<topic number>-<publisher number>
 			c := &PublisherClient{
 				ID:              fmt.Sprintf("%v-%v", t, i),
-				ClientID:        fmt.Sprintf("publisher-%v-%v-%v", t, i, time.Now().UTC().UnixMilli()), // mqtt-benchmark-<topic number>-<publisher number>
+				ClientID:        clientID,
 				BrokerURL:       *broker,
 				BrokerUser:      *username,
 				BrokerPass:      *password,
-				MsgTopic:        *topic + "-" + strconv.Itoa(t),
-				MsgPayload:      *payload,
+				MsgTopic:        clientTopic(topics[t], strconv.Itoa(i)),
 				MsgSize:         *size,
 				MsgCount:        *count,
 				MsgQoS:          byte(*qos),
@@ -184,11 +951,26 @@ func main() {
 				RemoteUser:      *remoteUser,
 				RemotePwd:       *remotePwd,
 				Remote:          remote,
+				CleanSession:    *cleanSession,
+				Conn:            newTracker(),
+				KeepAlive:       time.Duration(*keepAlive) * time.Second,
+				Verify:          *verify,
+				Inflight:        *inflight,
+				SizeDist:        sizeDistFor(t**publishersPerTopic + i),
+				Payload:         newPayload(clientID),
+				NoHeader:        noHeader,
+				Encoding:        encoding,
+				Content:         content,
+				Integrity:       sealer,
 			}
 			go c.Run(resCh)
 			time.Sleep(time.Duration(sleepTime*1000) * time.Millisecond)
 		}
 	}
+	if len(dropTimes) > 0 {
+		go dropConnections(start, dropTimes, trackers, *quiet)
+	}
+
 	// collect the results
 	results := make([]*RunResults, *publishersPerTopic**topicCount)
 	for i := 0; i < *publishersPerTopic**topicCount; i++ {
@@ -196,22 +978,101 @@ func main() {
 	}
 	totalTime := time.Since(start)
 
-	subThroughputs := make([]float64, *subscribersPerTopic**topicCount)
-	for i := 0; i < *subscribersPerTopic**topicCount; i++ {
-		subThroughputs[i] = <-subTpChannel
+	subResults := make([]*SubscriberResults, subscriberCount)
+	for i := 0; i < subscriberCount; i++ {
+		subResults[i] = <-subResCh
+	}
+
+	var idle *IdleResults
+	if *idleClients > 0 {
+		close(idleStop)
+		idleResults := make([]*IdleClientResults, *idleClients)
+		for i := 0; i < *idleClients; i++ {
+			idleResults[i] = <-idleResCh
+		}
+		idle = calculateIdleResults(idleResults)
 	}
 
 	for _, arrayPointer := range latenciesPointers {
 		latencies = append(latencies, *arrayPointer...)
 	}
 
-	totals := calculateTotalResults(results, totalTime, *publishersPerTopic**topicCount, latencies, subThroughputs)
+	totals := calculateTotalResults(results, totalTime, *publishersPerTopic**topicCount, latencies, subResults)
+	if encoding != nil {
+		totals.Encoding = *encodingName
+	}
+	if sealer != nil {
+		totals.Integrity = sealer.Algorithm
+	}
+	distinct := map[string]struct{}{}
+	for _, t := range published {
+		distinct[t] = struct{}{}
+	}
+	totals.Topics = len(distinct)
+	totals.TopicDepth = topicDepth
+	groupResults := []*ShareGroupResults{}
+	for _, g := range groups {
+		groupResults = append(groupResults, calculateShareGroupResults(g, subResults))
+		totals.MsgsLost += g.lost()
+	}
+	topicResults := []*TopicResults{}
+	fanOutResults := []*FanOutResults{}
+	if len(fanOutSubs) > 0 {
+		subsByTopic := make([][]*SubscriberResults, *topicCount)
+		for _, sub := range subResults {
+			if t, ok := topicIDs[sub.ID]; ok {
+				subsByTopic[t] = append(subsByTopic[t], sub)
+			}
+		}
+		for t := 0; t < *topicCount; t++ {
+			expected := int64(subscribersFor(t) * *publishersPerTopic * *count)
+			if *shareGroup != "" && subscribersFor(t) > 0 {
+				expected = int64(*publishersPerTopic * *count)
+			}
+			l := []uint64{}
+			for _, arrayPointer := range topicLatencies[t] {
+				l = append(l, *arrayPointer...)
+			}
+			topicResults = append(topicResults, calculateTopicResults(topics[t], expected, subsByTopic[t], l))
+		}
+		fanOutResults = calculateFanOutResults(topicResults)
+	}
+	fanInResults := []*FanInResults{}
+	for _, filter := range filters {
+		subs := []*SubscriberResults{}
+		for _, sub := range subResults {
+			if fanInIDs[sub.ID] == filter {
+				subs = append(subs, sub)
+			}
+		}
+		filterLatencies := []uint64{}
+		for _, arrayPointer := range fanInLatencies[filter] {
+			filterLatencies = append(filterLatencies, *arrayPointer...)
+		}
+		matched := matchingTopics(filter, topics)
+		fanInResults = append(fanInResults, calculateFanInResults(filter, matched, int64(matchingTopics(filter, published)**count), subs, filterLatencies))
+	}
+
+	var verifyResults *VerifyResults
+	if *verify {
+		verifyResults = calculateVerifyResults(byte(*qos), results, subResults, totals)
+	}
 
 	// print stats
-	printResults(results, totals, *format)
+	printResults(&JSONResults{
+		Runs:        results,
+		Subscribers: subResults,
+		Groups:      groupResults,
+		FanIn:       fanInResults,
+		Topics:      topicResults,
+		FanOut:      fanOutResults,
+		Idle:        idle,
+		Verify:      verifyResults,
+		Totals:      totals,
+	}, *format)
 }
 
-func calculateTotalResults(results []*RunResults, totalTime time.Duration, sampleSize int, latencies []uint64, subTp []float64) *TotalResults {
+func calculateTotalResults(results []*RunResults, totalTime time.Duration, sampleSize int, latencies []uint64, subResults []*SubscriberResults) *TotalResults {
 	totals := new(TotalResults)
 	totals.TotalRunTime = totalTime.Seconds()
 
@@ -220,16 +1081,53 @@ func calculateTotalResults(results []*RunResults, totalTime time.Duration, sampl
 	bws := make([]float64, len(results))
 	cpuUsage := make([]float64, len(results))
 	ramUsage := make([]float64, len(results))
+	subTp := make([]float64, len(subResults))
+	reconnectTimes := []float64{}
+	ackTimes := []float64{}
+	sizes := []float64{}
+	compression := compressionStats{}
 	// totals.MsgTimeMin = results[0].MsgTimeMin
 
-	for _, v := range subTp {
-		totals.TotalMsgsPerSecSubscriber += v
+	for i, res := range subResults {
+		subTp[i] = res.MsgsPerSec
+		totals.TotalMsgsPerSecSubscriber += res.MsgsPerSec
+		totals.MsgsLost += res.Lost
+		totals.MsgsDuplicated += res.Duplicates
+		totals.MsgsCorrupted += res.Corrupted
+		totals.MsgsTruncated += res.Truncated
+		totals.SubscriberSuccesses += res.Received
+		totals.SubscriberFailures += res.failures()
+		totals.TotalBytesSubscriber += res.Bytes
+		totals.TotalWireBytesSubscriber += res.WireBytes
+		totals.TotalMBPerSecSubscriber += res.MBPerSec
+		totals.TotalWireMBPerSecSub += res.WireMBPerSec
+		totals.Reconnects += res.Reconnects
+		reconnectTimes = append(reconnectTimes, res.ReconnectTimes...)
+		totals.DecodeErrors += res.DecodeErrors
+		totals.DecodeTimeAvg += res.DecodeTimeAvg * float64(res.Received)
+	}
+	if totals.DecodeTimeAvg > 0 {
+		received := int64(0)
+		for _, res := range subResults {
+			received += res.Received
+		}
+		totals.DecodeTimeAvg /= float64(received)
 	}
 
 	for i, res := range results {
 		totals.Successes += res.Successes
 		totals.Failures += res.Failures
 		totals.TotalMsgsPerSecPublisher += res.MsgsPerSec
+		totals.Reconnects += res.Reconnects
+		reconnectTimes = append(reconnectTimes, res.ReconnectTimes...)
+		ackTimes = append(ackTimes, res.ackTimes...)
+		sizes = append(sizes, res.sizes...)
+		totals.TotalBytes += res.Bytes
+		totals.TotalWireBytes += res.WireBytes
+		totals.TotalMBPerSecPublisher += res.MBPerSec
+		totals.TotalWireMBPerSecPub += res.WireMBPerSec
+		compression.in += res.compression.in
+		compression.out += res.compression.out
 
 		// if res.MsgTimeMin < totals.MsgTimeMin {
 		// 	totals.MsgTimeMin = res.MsgTimeMin
@@ -247,27 +1145,70 @@ func calculateTotalResults(results []*RunResults, totalTime time.Duration, sampl
 	}
 	latenciesFloat64 := stats.LoadRawData(latencies[:])
 	totals.Ratio = float64(totals.Successes) / float64(totals.Successes+totals.Failures)
+	if totals.SubscriberSuccesses+totals.SubscriberFailures > 0 {
+		totals.SubscriberRatio = float64(totals.SubscriberSuccesses) / float64(totals.SubscriberSuccesses+totals.SubscriberFailures)
+	}
 	totals.AvgMsgsPerSecPublisher, _ = stats.Mean(msgsPerSecs)
 	totals.AvgMsgsPerSecSubscriber, _ = stats.Mean(subTp)
+	if len(results) > 0 {
+		totals.AvgMBPerSecPublisher = totals.TotalMBPerSecPublisher / float64(len(results))
+	}
+	if len(subResults) > 0 {
+		totals.AvgMBPerSecSubscriber = totals.TotalMBPerSecSubscriber / float64(len(subResults))
+	}
 	totals.AvgRunTime, _ = stats.Mean(runTimes)
 	totals.TimeMeasurements = latenciesFloat64
-	totals.MsgTimeMin, _ = stats.Min(latenciesFloat64)
-	totals.MsgTimeMax, _ = stats.Max(latenciesFloat64)
-	totals.MsgTimeAvg, _ = stats.Mean(latenciesFloat64)
-	totals.MsgTimeStd, _ = stats.StandardDeviationSample(latenciesFloat64)
 	totals.AvgCpuUsage, _ = stats.Mean(cpuUsage)
 	totals.AvgMemoryUsage, _ = stats.Mean(ramUsage)
+	totals.AckLatency = calculateAckLatency(ackTimes)
+	// messages without header are not timed
+	if len(latenciesFloat64) > 0 {
+		totals.MsgTimeMin, _ = stats.Min(latenciesFloat64)
+		totals.MsgTimeMax, _ = stats.Max(latenciesFloat64)
+		totals.MsgTimeAvg, _ = stats.Mean(latenciesFloat64)
+		totals.MsgTimeStd, _ = stats.StandardDeviationSample(latenciesFloat64)
+		totals.MsgTimeP50, _ = stats.Percentile(latenciesFloat64, 50)
+		totals.MsgTimeP95, _ = stats.Percentile(latenciesFloat64, 95)
+		totals.MsgTimeP99, _ = stats.Percentile(latenciesFloat64, 99)
+	}
+	if len(sizes) > 0 {
+		totals.SizeMin, _ = stats.Min(sizes)
+		totals.SizeMax, _ = stats.Max(sizes)
+		totals.SizeAvg, _ = stats.Mean(sizes)
+		totals.SizeStd, _ = stats.StandardDeviationPopulation(sizes)
+		totals.SizeP50, _ = stats.Percentile(sizes, 50)
+		totals.SizeP99, _ = stats.Percentile(sizes, 99)
+	}
+	if len(reconnectTimes) > 0 {
+		totals.ReconnectTimeMin, _ = stats.Min(reconnectTimes)
+		totals.ReconnectTimeMax, _ = stats.Max(reconnectTimes)
+		totals.ReconnectTimeAvg, _ = stats.Mean(reconnectTimes)
+	}
+	totals.Compression = compression.ratio()
 
 	return totals
 }
 
-func printResults(results []*RunResults, totals *TotalResults, format string) {
+func calculateAckLatency(ackTimes []float64) AckLatency {
+	l := AckLatency{}
+	if len(ackTimes) == 0 {
+		return l
+	}
+	l.AckTimeMin, _ = stats.Min(ackTimes)
+	l.AckTimeMax, _ = stats.Max(ackTimes)
+	l.AckTimeAvg, _ = stats.Mean(ackTimes)
+	if len(ackTimes) > 1 {
+		l.AckTimeStd, _ = stats.StandardDeviationSample(ackTimes)
+	}
+	l.AckTimeP50, _ = stats.Percentile(ackTimes, 50)
+	l.AckTimeP95, _ = stats.Percentile(ackTimes, 95)
+	l.AckTimeP99, _ = stats.Percentile(ackTimes, 99)
+	return l
+}
+
+func printResults(jr *JSONResults, format string) {
 	switch format {
 	case "json":
-		jr := JSONResults{
-			Runs:   results,
-			Totals: totals,
-		}
 		data, err := json.Marshal(jr)
 		if err != nil {
 			log.Fatalf("Error marshalling results: %v", err)
@@ -277,28 +1218,133 @@ func printResults(results []*RunResults, totals *TotalResults, format string) {
 
 		fmt.Println(out.String())
 	default:
-		for _, res := range results {
+		for _, res := range jr.Runs {
 			fmt.Printf("======= PUBLISHER %v =======\n", res.ID)
 			fmt.Printf("Ratio:               %.3f (%d/%d)\n", float64(res.Successes)/float64(res.Successes+res.Failures), res.Successes, res.Successes+res.Failures)
 			// fmt.Printf("Runtime (s):         %.3f\n", res.RunTime)
 			fmt.Printf("Bandwidth (msg/sec): %.3f\n", res.MsgsPerSec)
+			fmt.Printf("Bandwidth (MB/sec):  %.3f (wire %.3f)\n", res.MBPerSec, res.WireMBPerSec)
+			fmt.Printf("Compression ratio:   %.3f\n", res.Compression)
+			if len(res.ackTimes) > 0 {
+				fmt.Printf("Ack time mean (ms):  %.3f\n", res.AckTimeAvg)
+				fmt.Printf("Ack time p99 (ms):   %.3f\n", res.AckTimeP99)
+			}
 			fmt.Printf("CPU Usage (percent): %.2f\n", res.CpuUsage)
 			fmt.Printf("RAM Usage (percent): %.2f\n\n", res.MemoryUsage)
 		}
-		fmt.Printf("========= TOTAL (%d) =========\n", len(results))
-		fmt.Printf("Total Ratio:                 %.3f (%d/%d)\n", totals.Ratio, totals.Successes, totals.Successes+totals.Failures)
-		fmt.Printf("Total Runtime (sec):         %.3f\n", totals.TotalRunTime)
-		fmt.Printf("Time measurements (ms): 	%.3f", totals.TimeMeasurements)
-		fmt.Printf("Msg time min (ms):           %.3f\n", totals.MsgTimeMin)
-		fmt.Printf("Msg time max (ms):           %.3f\n", totals.MsgTimeMax)
-		fmt.Printf("Msg time mean (ms):     	%.3f\n", totals.MsgTimeAvg)
-		fmt.Printf("Msg time std (ms):      	%.3f\n", totals.MsgTimeStd)
-		fmt.Printf("Average Bandwidth Per Publisher (msg/sec): %.3f\n", totals.AvgMsgsPerSecPublisher)
-		fmt.Printf("Total Bandwidth Publishers (msg/sec):   %.3f\n", totals.TotalMsgsPerSecPublisher)
-		fmt.Printf("Average Bandwidth Per Subscriber (msg/sec): %.3f\n", totals.AvgMsgsPerSecSubscriber)
-		fmt.Printf("Total Bandwidth Subscribers (msg/sec):   %.3f\n", totals.TotalMsgsPerSecSubscriber)
-		fmt.Printf("Average CPU Usage (percent): %.2f\n", totals.AvgCpuUsage)
-		fmt.Printf("Average RAM Usage (percent): %.2f\n", totals.AvgMemoryUsage)
+		fmt.Printf("========= TOTAL (%d) =========\n", len(jr.Runs))
+		fmt.Printf("Total Ratio:                 %.3f (%d/%d)\n", jr.Totals.Ratio, jr.Totals.Successes, jr.Totals.Successes+jr.Totals.Failures)
+		if len(jr.Subscribers) > 0 {
+			fmt.Printf("Subscriber Ratio:            %.3f (%d/%d)\n", jr.Totals.SubscriberRatio, jr.Totals.SubscriberSuccesses, jr.Totals.SubscriberSuccesses+jr.Totals.SubscriberFailures)
+		}
+		fmt.Printf("Total Runtime (sec):         %.3f\n", jr.Totals.TotalRunTime)
+		fmt.Printf("Topics:                      %d (depth %d)\n", jr.Totals.Topics, jr.Totals.TopicDepth)
+		fmt.Printf("Payload bytes published:     %d (wire %d)\n", jr.Totals.TotalBytes, jr.Totals.TotalWireBytes)
+		fmt.Printf("Payload bytes received:      %d (wire %d)\n", jr.Totals.TotalBytesSubscriber, jr.Totals.TotalWireBytesSubscriber)
+		fmt.Printf("Payload size min (bytes):    %.0f\n", jr.Totals.SizeMin)
+		fmt.Printf("Payload size max (bytes):    %.0f\n", jr.Totals.SizeMax)
+		fmt.Printf("Payload size mean (bytes):   %.1f\n", jr.Totals.SizeAvg)
+		fmt.Printf("Payload size std (bytes):    %.1f\n", jr.Totals.SizeStd)
+		fmt.Printf("Payload size p50 (bytes):    %.0f\n", jr.Totals.SizeP50)
+		fmt.Printf("Payload size p99 (bytes):    %.0f\n", jr.Totals.SizeP99)
+		fmt.Printf("Compression ratio (deflate): %.3f\n", jr.Totals.Compression)
+		if jr.Totals.Encoding != "" {
+			fmt.Printf("Encoding:                    %v\n", jr.Totals.Encoding)
+			fmt.Printf("Decode errors:               %d\n", jr.Totals.DecodeErrors)
+			fmt.Printf("Decode time mean (ms):       %.3f\n", jr.Totals.DecodeTimeAvg)
+		}
+		if jr.Totals.Integrity != "" {
+			fmt.Printf("Integrity:                   %v\n", jr.Totals.Integrity)
+			fmt.Printf("Messages corrupted:          %d\n", jr.Totals.MsgsCorrupted)
+			fmt.Printf("Messages truncated:          %d\n", jr.Totals.MsgsTruncated)
+		}
+		fmt.Printf("Time measurements (ms): 	%.3f", jr.Totals.TimeMeasurements)
+		fmt.Printf("Msg time min (ms):           %.3f\n", jr.Totals.MsgTimeMin)
+		fmt.Printf("Msg time max (ms):           %.3f\n", jr.Totals.MsgTimeMax)
+		fmt.Printf("Msg time mean (ms):     	%.3f\n", jr.Totals.MsgTimeAvg)
+		fmt.Printf("Msg time std (ms):      	%.3f\n", jr.Totals.MsgTimeStd)
+		fmt.Printf("Msg time p50 (ms):           %.3f\n", jr.Totals.MsgTimeP50)
+		fmt.Printf("Msg time p95 (ms):           %.3f\n", jr.Totals.MsgTimeP95)
+		fmt.Printf("Msg time p99 (ms):           %.3f\n", jr.Totals.MsgTimeP99)
+		if jr.Totals.AckTimeMax > 0 {
+			fmt.Printf("Ack time min (ms):           %.3f\n", jr.Totals.AckTimeMin)
+			fmt.Printf("Ack time max (ms):           %.3f\n", jr.Totals.AckTimeMax)
+			fmt.Printf("Ack time mean (ms):          %.3f\n", jr.Totals.AckTimeAvg)
+			fmt.Printf("Ack time std (ms):           %.3f\n", jr.Totals.AckTimeStd)
+			fmt.Printf("Ack time p50 (ms):           %.3f\n", jr.Totals.AckTimeP50)
+			fmt.Printf("Ack time p95 (ms):           %.3f\n", jr.Totals.AckTimeP95)
+			fmt.Printf("Ack time p99 (ms):           %.3f\n", jr.Totals.AckTimeP99)
+		}
+		fmt.Printf("Average Bandwidth Per Publisher (msg/sec): %.3f\n", jr.Totals.AvgMsgsPerSecPublisher)
+		fmt.Printf("Total Bandwidth Publishers (msg/sec):   %.3f\n", jr.Totals.TotalMsgsPerSecPublisher)
+		fmt.Printf("Average Bandwidth Per Subscriber (msg/sec): %.3f\n", jr.Totals.AvgMsgsPerSecSubscriber)
+		fmt.Printf("Total Bandwidth Subscribers (msg/sec):   %.3f\n", jr.Totals.TotalMsgsPerSecSubscriber)
+		fmt.Printf("Average Bandwidth Per Publisher (MB/sec):  %.3f\n", jr.Totals.AvgMBPerSecPublisher)
+		fmt.Printf("Total Bandwidth Publishers (MB/sec):    %.3f (wire %.3f)\n", jr.Totals.TotalMBPerSecPublisher, jr.Totals.TotalWireMBPerSecPub)
+		fmt.Printf("Average Bandwidth Per Subscriber (MB/sec): %.3f\n", jr.Totals.AvgMBPerSecSubscriber)
+		fmt.Printf("Total Bandwidth Subscribers (MB/sec):   %.3f (wire %.3f)\n", jr.Totals.TotalMBPerSecSubscriber, jr.Totals.TotalWireMBPerSecSub)
+		fmt.Printf("Average CPU Usage (percent): %.2f\n", jr.Totals.AvgCpuUsage)
+		fmt.Printf("Average RAM Usage (percent): %.2f\n", jr.Totals.AvgMemoryUsage)
+		if jr.Totals.Reconnects > 0 || jr.Totals.MsgsLost > 0 || jr.Totals.MsgsDuplicated > 0 {
+			fmt.Printf("Reconnects:                  %d\n", jr.Totals.Reconnects)
+			fmt.Printf("Reconnect time min (ms):     %.3f\n", jr.Totals.ReconnectTimeMin)
+			fmt.Printf("Reconnect time max (ms):     %.3f\n", jr.Totals.ReconnectTimeMax)
+			fmt.Printf("Reconnect time mean (ms):    %.3f\n", jr.Totals.ReconnectTimeAvg)
+			fmt.Printf("Messages lost:               %d\n", jr.Totals.MsgsLost)
+			fmt.Printf("Messages duplicated:         %d\n", jr.Totals.MsgsDuplicated)
+		}
+		for _, g := range jr.Groups {
+			fmt.Printf("======= SHARE GROUP %v =======\n", g.Filter)
+			fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(g.Received)/float64(g.Expected), g.Received, g.Expected)
+			fmt.Printf("Members:                     %d\n", g.Members)
+			fmt.Printf("Messages per member min:     %d\n", g.MinPerMember)
+			fmt.Printf("Messages per member max:     %d\n", g.MaxPerMember)
+			fmt.Printf("Messages per member std:     %.3f\n", g.StdPerMember)
+			fmt.Printf("Fairness (Jain index):       %.3f\n", g.Fairness)
+			fmt.Printf("Total Bandwidth (msg/sec):   %.3f\n", g.TotalMsgsPerSec)
+		}
+		for _, f := range jr.FanOut {
+			fmt.Printf("======= FAN-OUT %v SUBSCRIBERS (%d topics) =======\n", f.Subscribers, f.Topics)
+			fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(f.Received)/float64(f.Expected), f.Received, f.Expected)
+			fmt.Printf("Msg time mean (ms):          %.3f\n", f.MsgTimeAvg)
+			fmt.Printf("Msg time p50 (ms):           %.3f\n", f.MsgTimeP50)
+			fmt.Printf("Msg time p99 (ms):           %.3f\n", f.MsgTimeP99)
+			fmt.Printf("Msg time max (ms):           %.3f\n", f.MsgTimeMax)
+		}
+		for _, f := range jr.FanIn {
+			fmt.Printf("======= FAN-IN %v =======\n", f.Filter)
+			fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(f.Received)/float64(f.Expected), f.Received, f.Expected)
+			fmt.Printf("Matched topics:              %d\n", f.Topics)
+			fmt.Printf("Subscribers:                 %d\n", f.Subscribers)
+			fmt.Printf("Total Bandwidth (msg/sec):   %.3f\n", f.TotalMsgsPerSec)
+			fmt.Printf("Msg time mean (ms):          %.3f\n", f.MsgTimeAvg)
+			fmt.Printf("Msg time p99 (ms):           %.3f\n", f.MsgTimeP99)
+		}
+		if jr.Idle != nil {
+			fmt.Printf("========= IDLE (%d) =========\n", jr.Idle.Clients)
+			fmt.Printf("Connected:                   %d\n", jr.Idle.Connected)
+			fmt.Printf("Disconnects:                 %d\n", jr.Idle.Disconnects)
+			fmt.Printf("Pings:                       %d\n", jr.Idle.Pings)
+			fmt.Printf("Ping time min (ms):          %.3f\n", jr.Idle.PingTimeMin)
+			fmt.Printf("Ping time max (ms):          %.3f\n", jr.Idle.PingTimeMax)
+			fmt.Printf("Ping time mean (ms):         %.3f\n", jr.Idle.PingTimeAvg)
+			fmt.Printf("Ping time p99 (ms):          %.3f\n", jr.Idle.PingTimeP99)
+		}
+		if jr.Verify != nil {
+			verdict := "FAILED"
+			if jr.Verify.Passed {
+				verdict = "PASSED"
+			}
+			fmt.Printf("========= VERIFY QOS %d (%v) =========\n", jr.Verify.QoS, jr.Verify.Guarantee)
+			fmt.Printf("Acknowledged:                %d\n", jr.Verify.Acked)
+			fmt.Printf("Ack timeouts:                %d\n", jr.Verify.AckTimeouts)
+			fmt.Printf("Ack errors:                  %d\n", jr.Verify.AckErrors)
+			fmt.Printf("Received:                    %d\n", jr.Verify.Received)
+			fmt.Printf("Lost:                        %d\n", jr.Verify.Lost)
+			fmt.Printf("Duplicated:                  %d\n", jr.Verify.Duplicated)
+			fmt.Printf("Damaged:                     %d\n", jr.Verify.Damaged)
+			fmt.Printf("Result:                      %v\n", verdict)
+		}
 	}
 }
 
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PayloadGenerator builds the content of every message, the header is written in front of it unless disabled
+type PayloadGenerator interface {
+	Generate(seq int, sent time.Time) ([]byte, error)
+}
+
+// PayloadTemplate renders a text/template for every message, e.g. {"id":"{{uuid}}","temp":{{randFloat 10 30}}}.
+// Besides the text/template builtins, templates can use:
+//
+//	{{seq}}              the message sequence number of the publisher
+//	{{timestamp}}        the send time in milliseconds since the epoch
+//	{{timestampISO}}     the send time in RFC 3339 format
+//	{{clientId}}         the client id of the publisher
+//	{{uuid}}             a random UUID
+//	{{randInt a b}}      a random integer from a to b
+//	{{randFloat a b}}    a random float from a to b, with 2 decimals
+//	{{pick "x" "y"}}     a random value of the list
+//
+// A PayloadTemplate is used by a single publisher at a time
+type PayloadTemplate struct {
+	tmpl     *template.Template
+	clientID string
+	random   *rand.Rand
+	seq      int
+	sent     time.Time
+	buf      bytes.Buffer
+}
+
+// readPayloadTemplate returns the template given inline, or read from the file following @
+func readPayloadTemplate(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	data, err := os.ReadFile(strings.TrimPrefix(value, "@"))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func newPayloadTemplate(text string, clientID string) (*PayloadTemplate, error) {
+	p := &PayloadTemplate{
+		clientID: clientID,
+		random:   rand.New(rand.NewSource(int64(publisherKey(clientID)))),
+	}
+	tmpl, err := template.New("payload").Funcs(template.FuncMap{
+		"seq":          func() int { return p.seq },
+		"timestamp":    func() int64 { return p.sent.UTC().UnixMilli() },
+		"timestampISO": func() string { return p.sent.UTC().Format(time.RFC3339Nano) },
+		"clientId":     func() string { return p.clientID },
+		"uuid":         p.uuid,
+		"randInt": func(from, to int) int {
+			if to <= from {
+				return from
+			}
+			return from + p.random.Intn(to-from+1)
+		},
+		"randFloat": func(from, to float64) string {
+			return fmt.Sprintf("%.2f", from+p.random.Float64()*(to-from))
+		},
+		"pick": func(values ...string) string {
+			if len(values) == 0 {
+				return ""
+			}
+			return values[p.random.Intn(len(values))]
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload template: %v", err)
+	}
+	p.tmpl = tmpl
+	return p, nil
+}
+
+// Generate renders the template for the given message
+func (p *PayloadTemplate) Generate(seq int, sent time.Time) ([]byte, error) {
+	p.seq = seq
+	p.sent = sent
+	p.buf.Reset()
+	if err := p.tmpl.Execute(&p.buf, nil); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, p.buf.Bytes()...), nil
+}
+
+func (p *PayloadTemplate) uuid() string {
+	var b [16]byte
+	p.random.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// PayloadCorpus replays captured payloads, read from every file of a directory, from the lines of a file, or from
+// the JSON documents of a JSONL file (.jsonl or .ndjson)
+type PayloadCorpus struct {
+	Random   bool // sample the payloads at random instead of cycling through them
+	payloads [][]byte
+}
+
+// corpusCursor walks the corpus for a single publisher
+type corpusCursor struct {
+	corpus *PayloadCorpus
+	random *rand.Rand
+	next   int
+}
+
+func loadPayloadCorpus(path string) (*PayloadCorpus, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &PayloadCorpus{}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(path, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			c.payloads = append(c.payloads, data)
+		}
+	} else {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		jsonl := strings.HasSuffix(path, ".jsonl") || strings.HasSuffix(path, ".ndjson")
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) == 0 {
+				continue
+			}
+			if jsonl && !json.Valid(line) {
+				return nil, fmt.Errorf("%v line %v is not a JSON document", path, i+1)
+			}
+			c.payloads = append(c.payloads, line)
+		}
+	}
+	if len(c.payloads) == 0 {
+		return nil, fmt.Errorf("no payload in %v", path)
+	}
+	return c, nil
+}
+
+func newFixedPayload(payload string) *PayloadCorpus {
+	return &PayloadCorpus{payloads: [][]byte{[]byte(payload)}}
+}
+
+func (c *PayloadCorpus) generator(clientID string) PayloadGenerator {
+	return &corpusCursor{corpus: c, random: rand.New(rand.NewSource(int64(publisherKey(clientID))))}
+}
+
+// Generate returns the next payload of the corpus
+func (c *corpusCursor) Generate(seq int, sent time.Time) ([]byte, error) {
+	payloads := c.corpus.payloads
+	if c.corpus.Random {
+		return payloads[c.random.Intn(len(payloads))], nil
+	}
+	payload := payloads[c.next]
+	c.next = (c.next + 1) % len(payloads)
+	return payload, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// textAlphabet holds printable characters from the most to the least frequent in English text
+const textAlphabet = " etaoinshrdlucmfwypvbgkjqxzETAOINSHRDLUCMFWYPVBGKJQXZ0123456789.,;:!?-'\"()[]{}<>/@#$%&*+=_~^|\\`"
+
+// PayloadContent fills the generated payloads after the header:
+//
+//	zeros    zero bytes, compressing to almost nothing
+//	random   random bytes, which do not compress
+//	text     printable characters drawn from 2^Entropy symbols, compressing about 8/Entropy times
+type PayloadContent struct {
+	Mode    string
+	Entropy float64 // bits per character of text
+	symbols int
+}
+
+func newPayloadContent(mode string, entropy float64) (*PayloadContent, error) {
+	c := &PayloadContent{Mode: mode, Entropy: entropy}
+	switch mode {
+	case "zeros", "random":
+	case "text":
+		max := math.Log2(float64(len(textAlphabet)))
+		if entropy < 0 || entropy > max {
+			return nil, fmt.Errorf("text entropy should be from 0 to %.2f bits per character, given: %v", max, entropy)
+		}
+		c.symbols = int(math.Round(math.Exp2(entropy)))
+	default:
+		return nil, fmt.Errorf("unknown payload content %q", mode)
+	}
+	return c, nil
+}
+
+// Fill writes the content into b
+func (c *PayloadContent) Fill(b []byte, random *rand.Rand) {
+	switch c.Mode {
+	case "random":
+		random.Read(b)
+	case "text":
+		for i := range b {
+			b[i] = textAlphabet[random.Intn(c.symbols)]
+		}
+	}
+}
+
+// compressionStats compresses the first published payloads with deflate, as WebSocket permessage-deflate does. The
+// best compression level is used: the default level of compress/flate stores high entropy text where zlib still
+// compresses it
+type compressionStats struct {
+	w       *flate.Writer
+	buf     bytes.Buffer
+	samples int
+	in, out int64
+}
+
+// compressionSamples is the number of payloads compressed per publisher
+const compressionSamples = 100
+
+func (s *compressionStats) add(payload []byte) {
+	if s.samples >= compressionSamples {
+		return
+	}
+	s.buf.Reset()
+	if s.w == nil {
+		s.w, _ = flate.NewWriter(&s.buf, flate.BestCompression)
+	} else {
+		s.w.Reset(&s.buf)
+	}
+	s.w.Write(payload)
+	s.w.Close()
+	s.samples++
+	s.in += int64(len(payload))
+	s.out += int64(s.buf.Len())
+}
+
+// ratio returns the size of the payloads divided by their compressed size
+func (s *compressionStats) ratio() float64 {
+	if s.out == 0 {
+		return 0
+	}
+	return float64(s.in) / float64(s.out)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPayloadTemplate(t *testing.T) {
+	sent := time.UnixMilli(1700000000123)
+	for _, tc := range []struct {
+		template string
+		expected string
+	}{
+		{`{"seq":{{seq}}}`, `{"seq":7}`},
+		{`{{timestamp}}`, "1700000000123"},
+		{`{{timestampISO}}`, "2023-11-14T22:13:20.123Z"},
+		{`{{clientId}}/{{seq}}`, "publisher-1/7"},
+		{`{{randInt 5 5}} {{randInt 9 1}}`, "5 9"},
+		{`{{randFloat 2 2}}`, "2.00"},
+		{`{{pick "x"}}{{pick}}`, "x"},
+		{`{{if gt seq 5}}late{{end}}`, "late"},
+		{"no action", "no action"},
+	} {
+		p, err := newPayloadTemplate(tc.template, "publisher-1")
+		if err != nil {
+			t.Fatalf("%v: %v", tc.template, err)
+		}
+		payload, err := p.Generate(7, sent)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.template, err)
+		}
+		if string(payload) != tc.expected {
+			t.Errorf("%v: rendered %q, expected %q", tc.template, payload, tc.expected)
+		}
+	}
+}
+
+func TestPayloadTemplateRandom(t *testing.T) {
+	p, _ := newPayloadTemplate(`{{uuid}} {{randInt 1 3}} {{randFloat 10 20}} {{pick "a" "b"}}`, "publisher-1")
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12} ([1-3]) (\d+\.\d\d) [ab]$`)
+	first, _ := p.Generate(0, time.Now())
+	for i := 0; i < 1000; i++ {
+		payload, _ := p.Generate(i, time.Now())
+		match := format.FindStringSubmatch(string(payload))
+		if match == nil {
+			t.Fatalf("unexpected payload %q", payload)
+		}
+		if f, _ := strconv.ParseFloat(match[2], 64); f < 10 || f > 20 {
+			t.Errorf("randFloat out of range in %q", payload)
+		}
+	}
+
+	// the same client renders the same sequence of random values, and the payload is not reused
+	q, _ := newPayloadTemplate(`{{uuid}} {{randInt 1 3}} {{randFloat 10 20}} {{pick "a" "b"}}`, "publisher-1")
+	if again, _ := q.Generate(0, time.Now()); string(again) != string(first) {
+		t.Errorf("rendered %q, then %q with the same client id", first, again)
+	}
+}
+
+func TestPayloadTemplateInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{{seq",
+		"{{unknown}}",
+		"{{end}}",
+		"{{if seq}}",
+	} {
+		if _, err := newPayloadTemplate(template, "publisher-1"); err == nil {
+			t.Errorf("%v parsed", template)
+		}
+	}
+	// arguments are only checked when rendering
+	for _, template := range []string{
+		`{{randInt "a" 2}}`,
+		`{{randFloat 1}}`,
+	} {
+		p, err := newPayloadTemplate(template, "publisher-1")
+		if err != nil {
+			t.Fatalf("%v: %v", template, err)
+		}
+		if _, err := p.Generate(0, time.Now()); err == nil {
+			t.Errorf("%v rendered", template)
+		}
+	}
+}
+
+func TestReadPayloadTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payload.tmpl")
+	os.WriteFile(path, []byte(`{"seq":{{seq}}}`), 0o644)
+	if text, err := readPayloadTemplate("@" + path); err != nil || text != `{"seq":{{seq}}}` {
+		t.Errorf("read %q, %v", text, err)
+	}
+	if text, _ := readPayloadTemplate(`{"inline":true}`); text != `{"inline":true}` {
+		t.Errorf("read %q", text)
+	}
+	if _, err := readPayloadTemplate("@" + path + ".missing"); err == nil {
+		t.Errorf("missing template file read")
+	}
+}
+
+// writeFile writes a file of the test directory and returns its path
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPayloadCorpus(t *testing.T) {
+	dir := t.TempDir()
+	files := filepath.Join(dir, "files")
+	os.Mkdir(files, 0o755)
+	os.Mkdir(filepath.Join(files, "ignored"), 0o755)
+	writeFile(t, files, "a.bin", "first\nline")
+	writeFile(t, files, "b.bin", "second")
+
+	for _, tc := range []struct {
+		path     string
+		expected []string
+	}{
+		{files, []string{"first\nline", "second", "first\nline"}},
+		{writeFile(t, dir, "lines.txt", "a\r\n\nb\n"), []string{"a", "b", "a"}},
+		{writeFile(t, dir, "docs.jsonl", "{\"a\":1}\n[2]\n"), []string{`{"a":1}`, "[2]", `{"a":1}`}},
+	} {
+		c, err := loadPayloadCorpus(tc.path)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.path, err)
+		}
+		g := c.generator("publisher-1")
+		for i, expected := range tc.expected {
+			if payload, _ := g.Generate(i, time.Now()); string(payload) != expected {
+				t.Errorf("%v: payload %v is %q, expected %q", tc.path, i, payload, expected)
+			}
+		}
+	}
+
+	c, _ := loadPayloadCorpus(files)
+	c.Random = true
+	g := c.generator("publisher-1")
+	for i := 0; i < 100; i++ {
+		if payload, _ := g.Generate(i, time.Now()); string(payload) != "first\nline" && string(payload) != "second" {
+			t.Errorf("sampled %q", payload)
+		}
+	}
+}
+
+func TestPayloadCorpusInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{
+		filepath.Join(dir, "missing.txt"),
+		writeFile(t, dir, "empty.txt", "\n\r\n"),
+		writeFile(t, dir, "invalid.jsonl", "{\"a\":1}\n{\"a\":\n"),
+		writeFile(t, dir, "invalid.ndjson", "not json\n"),
+	} {
+		if _, err := loadPayloadCorpus(path); err == nil {
+			t.Errorf("%v loaded", path)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// protoEncoding encodes messages of a user supplied schema, read from a FileDescriptorSet as written by
+// protoc --descriptor_set_out (add --include_imports for messages of imported files). Fields are matched by name,
+// repeated scalars are written unpacked and read in both forms. Groups are not supported
+type protoEncoding struct {
+	messages map[string]*protoMessage
+	root     *protoMessage
+}
+
+type protoMessage struct {
+	name     string
+	fields   []*protoField
+	byName   map[string]*protoField
+	byNumber map[int]*protoField
+}
+
+type protoField struct {
+	name     string
+	number   int
+	repeated bool
+	kind     int    // FieldDescriptorProto.Type
+	typeName string // fully qualified message type name, e.g. .pkg.Message
+}
+
+// FieldDescriptorProto.Type values
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+)
+
+func loadProtoEncoding(path string, message string) (*protoEncoding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &protoEncoding{messages: map[string]*protoMessage{}}
+	// FileDescriptorSet: file = 1 (FileDescriptorProto: package = 2, message_type = 4)
+	err = protoFields(data, func(num int, wireType int, v uint64, file []byte) error {
+		if num != 1 {
+			return nil
+		}
+		pkg := ""
+		types := [][]byte{}
+		err := protoFields(file, func(num int, wireType int, v uint64, data []byte) error {
+			switch num {
+			case 2:
+				pkg = string(data)
+			case 4:
+				types = append(types, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		prefix := ""
+		if pkg != "" {
+			prefix = "." + pkg
+		}
+		for _, t := range types {
+			if err := e.addMessage(prefix, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %v: %v", path, err)
+	}
+
+	name := message
+	if !strings.HasPrefix(name, ".") {
+		name = "." + name
+	}
+	if e.root = e.messages[name]; e.root == nil {
+		return nil, fmt.Errorf("message %v not found in %v", message, path)
+	}
+	for _, m := range e.messages {
+		for _, f := range m.fields {
+			if f.kind == protoTypeGroup {
+				return nil, fmt.Errorf("field %v of %v: groups are not supported", f.name, m.name)
+			}
+			if f.kind == protoTypeMessage && e.messages[f.typeName] == nil {
+				return nil, fmt.Errorf("field %v of %v: unknown message type %v, use --include_imports", f.name, m.name, f.typeName)
+			}
+		}
+	}
+	for _, field := range []string{benchTimestamp, benchPublisher, benchSeq} {
+		f := e.root.byName[field]
+		if f == nil || f.repeated || (f.kind != protoTypeUint64 && f.kind != protoTypeInt64 && f.kind != protoTypeUint32 && f.kind != protoTypeFixed64) {
+			return nil, fmt.Errorf("message %v should declare the integer field %v to carry the latency metadata", message, field)
+		}
+	}
+	return e, nil
+}
+
+// addMessage adds a DescriptorProto (name = 1, field = 2, nested_type = 3) and its nested types
+func (e *protoEncoding) addMessage(prefix string, data []byte) error {
+	m := &protoMessage{byName: map[string]*protoField{}, byNumber: map[int]*protoField{}}
+	nested := [][]byte{}
+	err := protoFields(data, func(num int, wireType int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.name = prefix + "." + string(data)
+		case 2:
+			// FieldDescriptorProto: name = 1, number = 3, label = 4, type = 5, type_name = 6
+			f := &protoField{}
+			err := protoFields(data, func(num int, wireType int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					f.name = string(data)
+				case 3:
+					f.number = int(v)
+				case 4:
+					f.repeated = v == 3
+				case 5:
+					f.kind = int(v)
+				case 6:
+					f.typeName = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.fields = append(m.fields, f)
+		case 3:
+			nested = append(nested, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(m.fields, func(i, j int) bool { return m.fields[i].number < m.fields[j].number })
+	for _, f := range m.fields {
+		m.byName[f.name] = f
+		m.byNumber[f.number] = f
+	}
+	e.messages[m.name] = m
+	for _, n := range nested {
+		if err := e.addMessage(m.name, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *protoEncoding) Encode(fields map[string]interface{}) ([]byte, error) {
+	return e.encodeMessage(nil, e.root, fields)
+}
+
+func (e *protoEncoding) encodeMessage(b []byte, m *protoMessage, fields map[string]interface{}) ([]byte, error) {
+	for _, k := range sortedKeys(fields) {
+		if m.byName[k] == nil {
+			return nil, fmt.Errorf("field %v not in message %v", k, m.name)
+		}
+	}
+	var err error
+	for _, f := range m.fields {
+		v, ok := fields[f.name]
+		if !ok || v == nil {
+			continue
+		}
+		values := []interface{}{v}
+		if f.repeated {
+			if values, ok = v.([]interface{}); !ok {
+				return nil, fmt.Errorf("field %v of %v should be a list", f.name, m.name)
+			}
+		}
+		for _, v := range values {
+			if b, err = e.appendField(b, f, v); err != nil {
+				return nil, fmt.Errorf("field %v of %v: %v", f.name, m.name, err)
+			}
+		}
+	}
+	return b, nil
+}
+
+func protoNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case uint64:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (e *protoEncoding) appendField(b []byte, f *protoField, v interface{}) ([]byte, error) {
+	switch f.kind {
+	case protoTypeString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string")
+		}
+		return appendProtoBytes(b, f.number, []byte(s)), nil
+	case protoTypeBytes:
+		switch s := v.(type) {
+		case []byte:
+			return appendProtoBytes(b, f.number, s), nil
+		case string:
+			return appendProtoBytes(b, f.number, []byte(s)), nil
+		}
+		return nil, fmt.Errorf("expected bytes")
+	case protoTypeMessage:
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an object")
+		}
+		data, err := e.encodeMessage(nil, e.messages[f.typeName], fields)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoBytes(b, f.number, data), nil
+	}
+
+	// unsigned values keep their full range, other numbers go through float64 as decoded from JSON
+	u, unsigned := v.(uint64)
+	n, ok := protoNumber(v)
+	if !ok {
+		return nil, fmt.Errorf("expected a number")
+	}
+	if !unsigned {
+		u = uint64(int64(n))
+	}
+	switch f.kind {
+	case protoTypeDouble:
+		return binary.LittleEndian.AppendUint64(appendProtoTag(b, f.number, protoWireFixed64), math.Float64bits(n)), nil
+	case protoTypeFloat:
+		return binary.LittleEndian.AppendUint32(appendProtoTag(b, f.number, protoWireFixed32), math.Float32bits(float32(n))), nil
+	case protoTypeFixed64, protoTypeSfixed64:
+		return binary.LittleEndian.AppendUint64(appendProtoTag(b, f.number, protoWireFixed64), u), nil
+	case protoTypeFixed32, protoTypeSfixed32:
+		return binary.LittleEndian.AppendUint32(appendProtoTag(b, f.number, protoWireFixed32), uint32(u)), nil
+	case protoTypeSint32, protoTypeSint64:
+		i := int64(n)
+		return appendProtoVarint(b, f.number, uint64(i<<1)^uint64(i>>63)), nil
+	case protoTypeUint32:
+		return appendProtoVarint(b, f.number, uint64(uint32(u))), nil
+	}
+	// int32, int64, uint64, bool and enums are varints
+	return appendProtoVarint(b, f.number, u), nil
+}
+
+func (e *protoEncoding) Decode(payload []byte) (map[string]interface{}, error) {
+	return e.decodeMessage(e.root, payload)
+}
+
+func (e *protoEncoding) decodeMessage(m *protoMessage, data []byte) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	err := protoFields(data, func(num int, wireType int, v uint64, data []byte) error {
+		f := m.byNumber[num]
+		if f == nil {
+			return nil
+		}
+		values := []interface{}{}
+		scalar := f.kind != protoTypeString && f.kind != protoTypeBytes && f.kind != protoTypeMessage
+		if scalar && wireType == protoWireBytes {
+			// packed repeated scalars
+			for len(data) > 0 {
+				switch f.kind {
+				case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+					if len(data) < 8 {
+						return fmt.Errorf("truncated packed field %v", f.name)
+					}
+					v, data = binary.LittleEndian.Uint64(data), data[8:]
+				case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+					if len(data) < 4 {
+						return fmt.Errorf("truncated packed field %v", f.name)
+					}
+					v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+				default:
+					var n int
+					if v, n = binary.Uvarint(data); n <= 0 {
+						return fmt.Errorf("truncated packed field %v", f.name)
+					}
+					data = data[n:]
+				}
+				values = append(values, protoScalar(f.kind, v))
+			}
+		} else {
+			switch f.kind {
+			case protoTypeString:
+				values = append(values, string(data))
+			case protoTypeBytes:
+				values = append(values, append([]byte{}, data...))
+			case protoTypeMessage:
+				nested, err := e.decodeMessage(e.messages[f.typeName], data)
+				if err != nil {
+					return err
+				}
+				values = append(values, nested)
+			default:
+				values = append(values, protoScalar(f.kind, v))
+			}
+		}
+		if len(values) == 0 {
+			// an empty packed field
+			return nil
+		}
+		if !f.repeated {
+			fields[f.name] = values[len(values)-1]
+			return nil
+		}
+		list, _ := fields[f.name].([]interface{})
+		fields[f.name] = append(list, values...)
+		return nil
+	})
+	return fields, err
+}
+
+func protoScalar(kind int, v uint64) interface{} {
+	switch kind {
+	case protoTypeDouble:
+		return math.Float64frombits(v)
+	case protoTypeFloat:
+		return float64(math.Float32frombits(uint32(v)))
+	case protoTypeBool:
+		return v != 0
+	case protoTypeInt32, protoTypeEnum:
+		return int64(int32(v))
+	case protoTypeSfixed32:
+		return int64(int32(uint32(v)))
+	case protoTypeInt64, protoTypeSfixed64:
+		return int64(v)
+	case protoTypeSint32, protoTypeSint64:
+		return int64(v>>1) ^ -int64(v&1)
+	}
+	return v
+}
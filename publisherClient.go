@@ -3,12 +3,16 @@ package main
 import (
 	// "context"
 	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/montanaflynn/stats"
@@ -29,7 +33,7 @@ type PublisherClient struct {
 	BrokerUser      string
 	BrokerPass      string
 	MsgTopic        string
-	MsgPayload      string
+	MsgTopics       []string // when set, messages are published on these topics in turn instead of MsgTopic
 	MsgSize         int
 	MsgCount        int
 	MsgQoS          byte
@@ -41,6 +45,28 @@ type PublisherClient struct {
 	RemoteUser      string
 	RemotePwd       string
 	Remote          bool
+	CleanSession    bool
+	Conn            *ConnTracker
+	KeepAlive       time.Duration
+	Disconnect      bool // disconnect once every message is published
+	Retained        bool
+	Verify          bool              // wait for the PUBACK/PUBCOMP of every message, a message not acknowledged within WaitTimeout fails
+	Inflight        int               // publish asynchronously with at most this many unacknowledged messages, 0 waits for none
+	SizeDist        *SizeDistribution // when set, draws the size of every message instead of MsgSize
+	Payload         PayloadGenerator  // generates the content of every message instead of MsgSize zero bytes
+	NoHeader        bool              // generated payloads are sent without the header, e.g. for consumers parsing JSON
+	Content         *PayloadContent   // fills the MsgSize payloads, zeros when nil
+	Integrity       *Integrity        // seals every payload with its length and checksum
+	Encoding        PayloadEncoding   // encodes the messages with the latency metadata inside instead of the header
+	Replay          []RecordedMessage // reproduces a recorded stream instead of generating MsgCount messages
+	ReplaySpeed     float64           // replay time factor, 0 publishes as fast as possible
+
+	publishing     int32
+	reconnects     reconnectStats
+	connectTime    time.Duration
+	sessionPresent bool
+	connectErr     error
+	acks           ackStats
 }
 
 type Pair[T, U any] struct {
@@ -66,6 +92,9 @@ func (c *PublisherClient) Run(res chan *RunResults) {
 	runResults.ID = c.ID
 	cpuUsage := []float64{}
 	ramUsage := []float64{}
+	sizes := []float64{}
+	// compressed once publishing is done, not to slow down the receive loop
+	samples := [][]byte{}
 	ctr := 0
 	url, _ := extractHostnameFromURL(c.BrokerURL)
 
@@ -96,12 +125,22 @@ func (c *PublisherClient) Run(res chan *RunResults) {
 	for {
 		select {
 		case m := <-pubMsgsMqtt:
-			if m.Error {
+			if m.AckTimeout {
+				log.Printf("PUBLISHER %v ERROR message not acknowledged within %v: %v: at %v\n", c.ID, c.WaitTimeout, m.Topic, m.Sent.Unix())
+				runResults.Failures++
+				runResults.AckTimeouts++
+			} else if m.Error {
 				log.Printf("PUBLISHER %v ERROR publishing message: %v: at %v\n", c.ID, m.Topic, m.Sent.Unix())
 				runResults.Failures++
 			} else {
 				// log.Printf("Message published: %v: sent: %v delivered: %v flight time: %v\n", m.Topic, m.Sent, m.Delivered, m.Delivered.Sub(m.Sent))
 				runResults.Successes++
+				runResults.Bytes += int64(len(m.Payload))
+				runResults.WireBytes += publishWireSize(m.Topic, m.QoS, len(m.Payload))
+				sizes = append(sizes, float64(len(m.Payload)))
+				if len(samples) < compressionSamples {
+					samples = append(samples, m.Payload)
+				}
 
 				ctr++
 				if ctr%50 == 0 {
@@ -125,9 +164,33 @@ func (c *PublisherClient) Run(res chan *RunResults) {
 
 			duration := time.Since(started)
 			runResults.RunTime = duration.Seconds() - float64((c.MsgCount/100)*20)
-			runResults.MsgsPerSec = float64(runResults.Successes) / t
+			if t > 0 {
+				runResults.MsgsPerSec = float64(runResults.Successes) / t
+				runResults.MBPerSec = float64(runResults.Bytes) / t / 1e6
+				runResults.WireMBPerSec = float64(runResults.WireBytes) / t / 1e6
+			}
+			runResults.ConnectTime = float64(c.connectTime.Microseconds()) / 1000
+			runResults.SessionPresent = c.sessionPresent
+			if c.connectErr != nil {
+				runResults.ConnectError = c.connectErr.Error()
+				runResults.Failures += int64(c.MsgCount)
+			}
 			runResults.CpuUsage, _ = stats.Mean(cpuUsage)
 			runResults.MemoryUsage, _ = stats.Mean(ramUsage)
+			runResults.ReconnectTimes = c.reconnects.snapshot()
+			runResults.ackTimes = c.acks.snapshot()
+			runResults.AckLatency = calculateAckLatency(runResults.ackTimes)
+			runResults.sizes = sizes
+			if len(sizes) > 0 {
+				runResults.SizeMin, _ = stats.Min(sizes)
+				runResults.SizeMax, _ = stats.Max(sizes)
+				runResults.SizeAvg, _ = stats.Mean(sizes)
+			}
+			for _, p := range samples {
+				runResults.compression.add(p)
+			}
+			runResults.Compression = runResults.compression.ratio()
+			runResults.Reconnects = int64(len(runResults.ReconnectTimes))
 
 			if math.IsNaN(runResults.CpuUsage) {
 				runResults.CpuUsage = 0
@@ -181,15 +244,38 @@ func (c *PublisherClient) genMessagesMqttV2() *[]MessageMqtt {
 	minRand := 7000   // byte
 	maxRand := 600000 // byte
 	size := c.MsgSize
+	for _, r := range c.Replay {
+		m := MessageMqtt{Topic: r.Topic, QoS: r.QoS, Retained: r.Retain, Payload: r.Payload}
+		if !c.NoHeader {
+			m.Payload = make([]byte, headerLen+len(r.Payload))
+			copy(m.Payload[headerLen:], r.Payload)
+		}
+		msgs = append(msgs, m)
+	}
+	if c.Replay != nil {
+		return &msgs
+	}
 	for i := 0; i < c.MsgCount; i++ {
-		if c.MsgSize == 0 {
+		if c.SizeDist != nil {
+			size = c.SizeDist.Draw(&random)
+		} else if c.MsgSize == 0 {
 			size = random.Intn(maxRand-minRand) + minRand
 
 		}
+		topic := c.MsgTopic
+		if len(c.MsgTopics) > 0 {
+			topic = c.MsgTopics[i%len(c.MsgTopics)]
+		}
 		m := MessageMqtt{
-			Topic:   c.MsgTopic,
-			QoS:     c.MsgQoS,
-			Payload: make([]byte, size),
+			Topic: topic,
+			QoS:   c.MsgQoS,
+		}
+		// generated payloads are built when the message is sent
+		if c.Payload == nil {
+			m.Payload = make([]byte, size)
+			if c.Content != nil && size > headerLen {
+				c.Content.Fill(m.Payload[headerLen:], &random)
+			}
 		}
 		msgs = append(msgs, m)
 	}
@@ -197,29 +283,103 @@ func (c *PublisherClient) genMessagesMqttV2() *[]MessageMqtt {
 }
 
 func (c *PublisherClient) pubMessagesMqttV2(msgs *[]MessageMqtt, out chan *MessageMqtt, donePub chan float64) {
+	connected := make(chan struct{})
 	onConnected := func(client mqtt.Client) {
 		if !c.Quiet {
 			log.Printf("PUBLISHER %v is connected to the broker %v\n", c.ID, c.BrokerURL)
 		}
+		c.reconnects.connected()
+		// on reconnect the publishing loop is already running, paho resends the in-flight messages
+		if !atomic.CompareAndSwapInt32(&c.publishing, 0, 1) {
+			return
+		}
+		<-connected
+		key := publisherKey(c.ID)
 		ctr := 0
+		window := make(chan struct{}, c.Inflight)
+		var inflight sync.WaitGroup
+		// without window nor verification, the publishing pace does not depend on the broker: every acknowledgement
+		// is timed as soon as it arrives, and a single goroutine reports the timed messages in order
+		pending := make(chan chan *MessageMqtt, len(*msgs))
+		acked := make(chan struct{})
+		go func() {
+			defer close(acked)
+			for timed := range pending {
+				out <- <-timed
+			}
+		}()
+		publish := func(msg MessageMqtt, seq uint32) {
+			if c.Inflight > 0 {
+				window <- struct{}{}
+			}
+			msg.Sent = time.Now()
+			if c.Payload != nil || c.Encoding != nil {
+				payload, err := c.generate(msg.Sent, key, seq, msg.Payload)
+				if err != nil {
+					log.Printf("PUBLISHER %v ERROR generating payload: %v\n", c.ID, err)
+					msg.Error = true
+					if c.Inflight > 0 {
+						<-window
+					}
+					out <- &msg
+					return
+				}
+				msg.Payload = payload
+			} else if !c.NoHeader {
+				writeHeader(msg.Payload, msg.Sent, key, seq)
+			}
+			if c.Integrity != nil {
+				msg.Payload = c.Integrity.Seal(msg.Payload)
+			}
+			token := client.Publish(msg.Topic, msg.QoS, c.Retained || msg.Retained, msg.Payload)
+			if c.Inflight > 0 {
+				// the message completes once acknowledged, releasing its slot of the window
+				inflight.Add(1)
+				go func() {
+					defer inflight.Done()
+					c.verify(token, &msg)
+					<-window
+					out <- &msg
+				}()
+				return
+			}
+			if c.Verify {
+				c.verify(token, &msg)
+				out <- &msg
+				return
+			}
+			timed := make(chan *MessageMqtt, 1)
+			go func() {
+				c.verify(token, &msg)
+				timed <- &msg
+			}()
+			pending <- timed
+		}
 		globalTime := time.Now()
 
-		if c.MessageInterval > 0 {
+		if c.Replay != nil {
+			// reproduce the recorded timing, scaled by the replay speed
+			for ctr < len(*msgs) {
+				if c.ReplaySpeed > 0 {
+					time.Sleep(time.Until(globalTime.Add(time.Duration(float64(c.Replay[ctr].Offset) / c.ReplaySpeed))))
+				}
+				publish((*msgs)[ctr], uint32(ctr))
+
+				if !c.Quiet {
+					if ctr > 0 && ctr%100 == 0 {
+						log.Printf("PUBLISHER %v published %v messages and keeps publishing...\n", c.ID, ctr)
+					}
+				}
+				ctr++
+			}
+		} else if c.MessageInterval > 0 {
 
 			// ticker provides a more precise interval
 			ticker := time.NewTicker(time.Millisecond * time.Duration(c.MessageInterval))
 			defer ticker.Stop()
 			for range ticker.C {
 				msg := (*msgs)[ctr]
-				msg.Sent = time.Now()
-				for i := 0; i < 8; i++ {
-					msg.Payload[i] = byte(uint64(msg.Sent.UTC().UnixMilli()) >> (8 * (i)))
-				}
-				client.Publish(msg.Topic, msg.QoS, false, msg.Payload)
-				msg.Delivered = time.Now()
-				msg.Error = false
-
-				out <- &msg
+				publish(msg, uint32(ctr))
 
 				if !c.Quiet {
 					if ctr > 0 && ctr%100 == 0 {
@@ -233,15 +393,7 @@ func (c *PublisherClient) pubMessagesMqttV2(msgs *[]MessageMqtt, out chan *Messa
 			}
 		} else { // for interval of 0
 			for _, msg := range *msgs {
-				msg.Sent = time.Now()
-				for i := 0; i < 8; i++ {
-					msg.Payload[i] = byte(uint64(msg.Sent.UTC().UnixMilli()) >> (8 * (i)))
-				}
-				client.Publish(msg.Topic, msg.QoS, false, msg.Payload)
-				msg.Delivered = time.Now()
-				msg.Error = false
-
-				out <- &msg
+				publish(msg, uint32(ctr))
 
 				if !c.Quiet {
 					if ctr > 0 && ctr%100 == 0 {
@@ -253,7 +405,16 @@ func (c *PublisherClient) pubMessagesMqttV2(msgs *[]MessageMqtt, out chan *Messa
 			}
 		}
 
-		donePub <- time.Since(globalTime).Seconds()
+		inflight.Wait()
+		publishTime := time.Since(globalTime).Seconds()
+		// waits at most WaitTimeout after the last message for the outstanding acknowledgements
+		close(pending)
+		<-acked
+		if c.Disconnect {
+			// every in-flight message was acknowledged or timed out above
+			client.Disconnect(250)
+		}
+		donePub <- publishTime
 		if !c.Quiet {
 			log.Printf("PUBLISHER %v is done publishing in %v\n", c.ID, time.Since(globalTime).Seconds())
 		}
@@ -262,10 +423,11 @@ func (c *PublisherClient) pubMessagesMqttV2(msgs *[]MessageMqtt, out chan *Messa
 	opts := mqtt.NewClientOptions().
 		AddBroker(c.BrokerURL).
 		SetClientID(c.ClientID).
-		SetCleanSession(true).
+		SetCleanSession(c.CleanSession).
 		SetAutoReconnect(true).
 		SetOnConnectHandler(onConnected).
 		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			c.reconnects.lost()
 			log.Printf("PUBLISHER %v lost connection to the broker: %v. Will reconnect...\n", c.ID, reason.Error())
 		})
 	if c.BrokerUser != "" && c.BrokerPass != "" {
@@ -275,13 +437,99 @@ func (c *PublisherClient) pubMessagesMqttV2(msgs *[]MessageMqtt, out chan *Messa
 	if c.TLSConfig != nil {
 		opts.SetTLSConfig(c.TLSConfig)
 	}
-	opts.SetKeepAlive(0)
+	if c.Conn != nil {
+		opts.SetCustomOpenConnectionFn(c.Conn.openConnection)
+	}
+	opts.SetKeepAlive(c.KeepAlive)
 
 	client := mqtt.NewClient(opts)
+	started := time.Now()
 	token := client.Connect()
 	token.Wait()
+	c.connectTime = time.Since(started)
+	if ct, ok := token.(*mqtt.ConnectToken); ok {
+		c.sessionPresent = ct.SessionPresent()
+	}
+	close(connected)
 
 	if token.Error() != nil {
 		log.Printf("PUBLISHER %v had error connecting to the broker: %v\n", c.ID, token.Error())
+		c.connectErr = token.Error()
+		donePub <- 0
+	}
+}
+
+// generate builds the payload of a message with the payload generator, after the header unless disabled, or encodes
+// it when an encoding is set
+func (c *PublisherClient) generate(sent time.Time, key uint32, seq uint32, data []byte) ([]byte, error) {
+	if c.Encoding != nil {
+		return c.encode(sent, key, seq, data)
+	}
+	content, err := c.Payload.Generate(int(seq), sent)
+	if err != nil || c.NoHeader {
+		return content, err
 	}
+	payload := make([]byte, headerLen, headerLen+len(content))
+	writeHeader(payload, sent, key, seq)
+	return append(payload, content...), nil
+}
+
+// encode encodes the generated payload, which must be a JSON object, or a message whose data field holds the
+// MsgSize bytes when there is no payload generator
+func (c *PublisherClient) encode(sent time.Time, key uint32, seq uint32, data []byte) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if c.Payload == nil {
+		fields["data"] = data
+	} else {
+		content, err := c.Payload.Generate(int(seq), sent)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &fields); err != nil {
+			return nil, fmt.Errorf("cannot encode a payload which is not a JSON object: %v", err)
+		}
+	}
+	return encodeMessage(c.Encoding, fields, sent, key, seq)
+}
+
+// verify waits for the acknowledgement of a message until WaitTimeout after it was sent, QoS 1 completes on PUBACK
+// and QoS 2 on PUBCOMP, QoS 0 as soon as the message is written to the network
+func (c *PublisherClient) verify(token mqtt.Token, msg *MessageMqtt) {
+	select {
+	case <-token.Done():
+	default:
+		timer := time.NewTimer(time.Until(msg.Sent.Add(c.WaitTimeout)))
+		defer timer.Stop()
+		select {
+		case <-token.Done():
+		case <-timer.C:
+			msg.Error = true
+			msg.AckTimeout = true
+			return
+		}
+	}
+	msg.Delivered = time.Now()
+	msg.Error = token.Error() != nil
+	if !msg.Error {
+		c.acks.record(msg.Delivered.Sub(msg.Sent))
+	}
+}
+
+// ackStats records the publish-to-ack latency of every acknowledged message
+type ackStats struct {
+	mu    sync.Mutex
+	times []float64
+}
+
+func (s *ackStats) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times = append(s.times, float64(d.Microseconds())/1000)
+}
+
+// snapshot returns the ack latencies in milliseconds
+func (s *ackStats) snapshot() []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]float64{}, s.times...)
 }
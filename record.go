@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// RecordBenchmark subscribes to topic filters and records the traffic to a file, to be reproduced by the replay mode.
+// Recording stops after Duration or on interrupt
+type RecordBenchmark struct {
+	BrokerURL  string
+	BrokerUser string
+	BrokerPass string
+	TLSConfig  *tls.Config
+	Filters    []string
+	MsgQoS     byte
+	Path       string
+	Duration   time.Duration
+	Quiet      bool
+}
+
+// RecordResults describes a recording
+type RecordResults struct {
+	Path       string  `json:"path"`
+	Messages   int64   `json:"messages"`
+	Topics     int     `json:"topics"`
+	Bytes      int64   `json:"bytes"`
+	FileBytes  int64   `json:"file_bytes"`
+	Duration   float64 `json:"duration"`
+	MsgsPerSec float64 `json:"msgs_per_sec"`
+}
+
+// Run records until the duration elapses or the process is interrupted
+func (b *RecordBenchmark) Run() *RecordResults {
+	res := &RecordResults{Path: b.Path}
+	f, err := os.Create(b.Path)
+	if err != nil {
+		log.Fatalf("Cannot create the recording %v: %v", b.Path, err)
+	}
+	defer f.Close()
+	w, err := newRecordingWriter(f)
+	if err != nil {
+		log.Fatalf("Cannot write the recording %v: %v", b.Path, err)
+	}
+
+	var mu sync.Mutex
+	var started time.Time
+	stopped := false
+	onMessage := func(client mqtt.Client, m mqtt.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		err := w.Write(RecordedMessage{
+			Offset:  time.Since(started),
+			Topic:   m.Topic(),
+			QoS:     m.Qos(),
+			Retain:  m.Retained(),
+			Payload: m.Payload(),
+		})
+		if err != nil {
+			log.Fatalf("Cannot write the recording %v: %v", b.Path, err)
+		}
+		res.Messages++
+		res.Bytes += int64(len(m.Payload()))
+		if !b.Quiet && res.Messages%1000 == 0 {
+			log.Printf("RECORDER recorded %v messages and keeps recording...\n", res.Messages)
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(fmt.Sprintf("recorder-%v", time.Now().UTC().UnixMilli())).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			log.Printf("RECORDER lost connection to the broker: %v. Will reconnect...\n", reason.Error())
+		})
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("RECORDER had error connecting to the broker: %v", token.Error())
+	}
+
+	filters := map[string]byte{}
+	for _, filter := range b.Filters {
+		filters[filter] = b.MsgQoS
+	}
+	mu.Lock()
+	started = time.Now()
+	mu.Unlock()
+	if token := client.SubscribeMultiple(filters, onMessage); token.Wait() && token.Error() != nil {
+		log.Fatalf("RECORDER had error subscribing to %v: %v", b.Filters, token.Error())
+	}
+	if !b.Quiet {
+		log.Printf("RECORDER is recording %v to %v for %v, interrupt to stop earlier\n", b.Filters, b.Path, b.Duration)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	select {
+	case <-time.After(b.Duration):
+	case <-interrupt:
+	}
+
+	mu.Lock()
+	stopped = true
+	res.Duration = time.Since(started).Seconds()
+	mu.Unlock()
+	client.Disconnect(250)
+
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Cannot write the recording %v: %v", b.Path, err)
+	}
+	if info, err := f.Stat(); err == nil {
+		res.FileBytes = info.Size()
+	}
+	res.Topics = len(w.topics)
+	if res.Duration > 0 {
+		res.MsgsPerSec = float64(res.Messages) / res.Duration
+	}
+	return res
+}
+
+func printRecordResults(res *RecordResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= RECORD (%v) =========\n", res.Path)
+		fmt.Printf("Messages:                    %d\n", res.Messages)
+		fmt.Printf("Topics:                      %d\n", res.Topics)
+		fmt.Printf("Payload bytes:               %d\n", res.Bytes)
+		fmt.Printf("File bytes:                  %d\n", res.FileBytes)
+		fmt.Printf("Duration (sec):              %.3f\n", res.Duration)
+		fmt.Printf("Message rate (msg/sec):      %.3f\n", res.MsgsPerSec)
+	}
+}
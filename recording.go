@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Recordings start with recordingMagic and a version byte, followed by one entry per message:
+//
+//	uvarint  microseconds since the previous message
+//	uvarint  topic reference, a new topic is referenced by the number of topics seen so far and followed by
+//	         its uvarint length and bytes
+//	byte     QoS in the 2 low bits, retain flag in the third
+//	uvarint  payload length, followed by the payload
+const (
+	recordingMagic   = "MQRC"
+	recordingVersion = 1
+)
+
+// RecordedMessage is a message of a recording, Offset is its arrival time since the start of the recording
+type RecordedMessage struct {
+	Offset  time.Duration
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Payload []byte
+}
+
+// recordingWriter appends messages to a recording, it is not safe for concurrent use
+type recordingWriter struct {
+	w      *bufio.Writer
+	topics map[string]uint64
+	last   time.Duration
+	buf    [binary.MaxVarintLen64]byte
+}
+
+func newRecordingWriter(w io.Writer) (*recordingWriter, error) {
+	r := &recordingWriter{w: bufio.NewWriter(w), topics: map[string]uint64{}}
+	if _, err := r.w.WriteString(recordingMagic); err != nil {
+		return nil, err
+	}
+	if err := r.w.WriteByte(recordingVersion); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recordingWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(r.buf[:], v)
+	r.w.Write(r.buf[:n])
+}
+
+func (r *recordingWriter) Write(m RecordedMessage) error {
+	delta := m.Offset - r.last
+	if delta < 0 {
+		delta = 0
+	}
+	r.last += delta
+	r.uvarint(uint64(delta.Microseconds()))
+	if ref, ok := r.topics[m.Topic]; ok {
+		r.uvarint(ref)
+	} else {
+		ref = uint64(len(r.topics))
+		r.topics[m.Topic] = ref
+		r.uvarint(ref)
+		r.uvarint(uint64(len(m.Topic)))
+		r.w.WriteString(m.Topic)
+	}
+	flags := m.QoS & 3
+	if m.Retain {
+		flags |= 4
+	}
+	r.w.WriteByte(flags)
+	r.uvarint(uint64(len(m.Payload)))
+	_, err := r.w.Write(m.Payload)
+	return err
+}
+
+func (r *recordingWriter) Flush() error {
+	return r.w.Flush()
+}
+
+// readRecording reads every message of a recording
+func readRecording(path string) ([]RecordedMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	head := make([]byte, len(recordingMagic)+1)
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:len(recordingMagic)]) != recordingMagic {
+		return nil, fmt.Errorf("%v is not a recording", path)
+	}
+	if head[len(recordingMagic)] != recordingVersion {
+		return nil, fmt.Errorf("%v has unsupported recording version %v", path, head[len(recordingMagic)])
+	}
+
+	msgs := []RecordedMessage{}
+	topics := []string{}
+	var offset time.Duration
+	for {
+		delta, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: truncated recording after %v messages", path, len(msgs))
+		}
+		offset += time.Duration(delta) * time.Microsecond
+		m := RecordedMessage{Offset: offset}
+		if m.Topic, err = readRecordedTopic(r, &topics); err == nil {
+			var flags byte
+			if flags, err = r.ReadByte(); err == nil {
+				m.QoS = flags & 3
+				m.Retain = flags&4 != 0
+				m.Payload, err = readRecordedBytes(r)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: truncated recording after %v messages", path, len(msgs))
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func readRecordedTopic(r *bytes.Reader, topics *[]string) (string, error) {
+	ref, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if ref < uint64(len(*topics)) {
+		return (*topics)[ref], nil
+	}
+	if ref != uint64(len(*topics)) {
+		return "", fmt.Errorf("unknown topic reference %v", ref)
+	}
+	topic, err := readRecordedBytes(r)
+	if err != nil {
+		return "", err
+	}
+	*topics = append(*topics, string(topic))
+	return string(topic), nil
+}
+
+func readRecordedBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// parseTopicRemap parses comma separated from=to topic prefix replacements, e.g. plant/=bench/plant/
+func parseTopicRemap(value string) ([]Pair[string, string], error) {
+	remap := []Pair[string, string]{}
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid topic remap %q, expected <from>=<to>", rule)
+		}
+		remap = append(remap, Pair[string, string]{First: from, Second: to})
+	}
+	return remap, nil
+}
+
+// remapTopic replaces the prefix of the first matching rule
+func remapTopic(topic string, remap []Pair[string, string]) string {
+	for _, rule := range remap {
+		if strings.HasPrefix(topic, rule.First) {
+			return rule.Second + strings.TrimPrefix(topic, rule.First)
+		}
+	}
+	return topic
+}
+
+// splitRecording remaps the topics of a recording and splits it between publishers, every topic being published by a
+// single publisher so that its messages keep their order. The silence before the first message is skipped
+func splitRecording(msgs []RecordedMessage, remap []Pair[string, string], publishers int) [][]RecordedMessage {
+	streams := make([][]RecordedMessage, publishers)
+	owners := map[string]int{}
+	for _, m := range msgs {
+		m.Topic = remapTopic(m.Topic, remap)
+		m.Offset -= msgs[0].Offset
+		owner, ok := owners[m.Topic]
+		if !ok {
+			owner = len(owners) % publishers
+			owners[m.Topic] = owner
+		}
+		streams[owner] = append(streams[owner], m)
+	}
+	return streams
+}
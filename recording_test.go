@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleRecording holds repeated and new topics, every QoS, retained and empty payloads, a payload crossing the
+// single byte length, and an offset going back in time
+func sampleRecording() []RecordedMessage {
+	return []RecordedMessage{
+		{Offset: time.Second, Topic: "plant/a/temp", QoS: 0, Payload: []byte("21.5")},
+		{Offset: time.Second + 1500*time.Microsecond, Topic: "plant/b/temp", QoS: 1, Retain: true, Payload: []byte{}},
+		{Offset: 3 * time.Second, Topic: "plant/a/temp", QoS: 2, Payload: bytes.Repeat([]byte{0xff}, 300)},
+		{Offset: 3 * time.Second, Topic: "", QoS: 1, Payload: []byte("x")},
+		{Offset: 2 * time.Second, Topic: "plant/b/temp", QoS: 0, Retain: true, Payload: []byte("y")},
+	}
+}
+
+// writeRecording writes the messages to a recording and returns its content
+func writeRecording(t *testing.T, msgs []RecordedMessage) []byte {
+	var buf bytes.Buffer
+	w, err := newRecordingWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		if err := w.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.mqrc")
+	os.WriteFile(path, writeRecording(t, sampleRecording()), 0o644)
+	msgs, err := readRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sampleRecording()
+	// offsets never go back in time
+	expected[4].Offset = 3 * time.Second
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("read %+v, expected %+v", msgs, expected)
+	}
+}
+
+func TestRecordingTruncated(t *testing.T) {
+	data := writeRecording(t, sampleRecording())
+	path := filepath.Join(t.TempDir(), "recording.mqrc")
+	complete := 0
+	for i := 0; i < len(data); i++ {
+		os.WriteFile(path, data[:i], 0o644)
+		msgs, err := readRecording(path)
+		if err != nil {
+			continue
+		}
+		// a recording cut between two messages is read up to the cut
+		if i < len(recordingMagic)+1 || len(msgs) >= len(sampleRecording()) {
+			t.Fatalf("recording truncated to %v bytes read %v messages", i, len(msgs))
+		}
+		complete++
+	}
+	if complete != len(sampleRecording()) {
+		t.Errorf("%v truncated recordings read, expected one per message boundary", complete)
+	}
+}
+
+func TestRecordingInvalid(t *testing.T) {
+	head := recordingMagic + string([]byte{recordingVersion})
+	for name, data := range map[string]string{
+		"empty":         "",
+		"bad magic":     "MQRX\x01",
+		"bad version":   recordingMagic + "\x02",
+		"huge topic":    head + "\x00\x00\xff\xff\xff\xff\xff\xff\xff\xff\x7f",
+		"huge payload":  head + "\x00\x00\x01a\x00\xff\xff\xff\xff\x0f",
+		"unknown topic": head + "\x00\x01\x01a\x00\x00",
+		"overlong uvarint": head + "\x00\x00\x01a\x00" +
+			"\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+	} {
+		path := filepath.Join(t.TempDir(), "recording.mqrc")
+		os.WriteFile(path, []byte(data), 0o644)
+		if _, err := readRecording(path); err == nil {
+			t.Errorf("%v read", name)
+		}
+	}
+	if _, err := readRecording(filepath.Join(t.TempDir(), "missing.mqrc")); err == nil {
+		t.Errorf("missing recording read")
+	}
+}
+
+func TestTopicRemap(t *testing.T) {
+	remap, err := parseTopicRemap(" plant/=bench/plant/ ,,plant=other,a/=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for topic, expected := range map[string]string{
+		"plant/a/temp": "bench/plant/a/temp",
+		"plants/a":     "others/a",
+		"a/b":          "b",
+		"b/a/":         "b/a/",
+	} {
+		if remapped := remapTopic(topic, remap); remapped != expected {
+			t.Errorf("%v remapped to %v, expected %v", topic, remapped, expected)
+		}
+	}
+	if _, err := parseTopicRemap("plant/"); err == nil {
+		t.Errorf("remap without = parsed")
+	}
+}
+
+func TestSplitRecording(t *testing.T) {
+	msgs := sampleRecording()
+	remap, _ := parseTopicRemap("plant/=bench/")
+	streams := splitRecording(msgs, remap, 2)
+	if len(streams) != 2 || len(streams[0]) != 3 || len(streams[1]) != 2 {
+		t.Fatalf("split in %v", streams)
+	}
+	owners := map[string]int{}
+	for i, stream := range streams {
+		for j, m := range stream {
+			if strings.HasPrefix(m.Topic, "plant/") {
+				t.Errorf("%v not remapped", m.Topic)
+			}
+			if owner, ok := owners[m.Topic]; ok && owner != i {
+				t.Errorf("%v published by publishers %v and %v", m.Topic, owner, i)
+			}
+			owners[m.Topic] = i
+			if j > 0 && m.Offset < stream[j-1].Offset && m.Topic == stream[j-1].Topic {
+				t.Errorf("%v reordered", m.Topic)
+			}
+		}
+	}
+	// the silence before the first message is skipped
+	if streams[0][0].Offset != 0 || streams[1][0].Offset != 1500*time.Microsecond {
+		t.Errorf("first offsets %v and %v", streams[0][0].Offset, streams[1][0].Offset)
+	}
+	// more publishers than topics leave some idle
+	if streams := splitRecording(msgs, nil, 5); len(streams[3]) != 0 || len(streams[4]) != 0 {
+		t.Errorf("split in %v", streams)
+	}
+}
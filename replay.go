@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ReplayBenchmark reproduces a recording with its timing, each topic being published by a single publisher to keep its
+// order, while subscribers to the recorded filters measure the replayed stream. The retained messages replayed are
+// cleared at the end
+type ReplayBenchmark struct {
+	BrokerURL   string
+	BrokerUser  string
+	BrokerPass  string
+	TLSConfig   *tls.Config
+	Recording   []RecordedMessage
+	Remap       []Pair[string, string]
+	Filters     []string // recorded filters, remapped as the topics
+	Publishers  int
+	Subscribers int // number of subscribers per filter
+	Speed       float64
+	MsgQoS      byte // QoS of the subscribers
+	WaitTimeout time.Duration
+	KeepAlive   time.Duration
+	Verify      bool
+	Inflight    int
+	NoHeader    bool
+	Integrity   *Integrity
+	Remote      bool
+	RemoteUser  string
+	RemotePwd   string
+	Quiet       bool
+}
+
+// Run replays the recording and returns the results of the publishers and subscribers
+func (b *ReplayBenchmark) Run() *JSONResults {
+	runStamp := time.Now().UTC().UnixMilli()
+	streams := splitRecording(b.Recording, b.Remap, b.Publishers)
+	replayed := []string{}
+	distinct := map[string]struct{}{}
+	retained := map[string]struct{}{}
+	for _, m := range b.Recording {
+		topic := remapTopic(m.Topic, b.Remap)
+		replayed = append(replayed, topic)
+		distinct[topic] = struct{}{}
+		if m.Retain {
+			retained[topic] = struct{}{}
+		}
+	}
+
+	// subscribers expect every replayed message matching their filter
+	resCh := make(chan *RunResults)
+	subResCh := make(chan *SubscriberResults)
+	subscribed := &sync.WaitGroup{}
+	latenciesPointers := []*[]uint64{}
+	subscriberCount := 0
+	for f, filter := range b.Filters {
+		filter = remapTopic(filter, b.Remap)
+		expected := matchingTopics(filter, replayed)
+		if expected == 0 {
+			continue
+		}
+		for i := 0; i < b.Subscribers; i++ {
+			array := []uint64{}
+			c := &SubscriberClient{
+				ID:            fmt.Sprintf("replay-%v-%v", f, i),
+				ClientID:      fmt.Sprintf("subscriber-replay-%v-%v-%v", f, i, runStamp),
+				BrokerURL:     b.BrokerURL,
+				BrokerUser:    b.BrokerUser,
+				BrokerPass:    b.BrokerPass,
+				MsgTopic:      filter,
+				TopicMsgCount: expected,
+				MsgQoS:        b.MsgQoS,
+				TLSConfig:     b.TLSConfig,
+				Quiet:         b.Quiet,
+				Timeout:       15,
+				CleanSession:  true,
+				Ready:         subscribed,
+				NoHeader:      b.NoHeader,
+				Integrity:     b.Integrity,
+			}
+			latenciesPointers = append(latenciesPointers, &array)
+			subscriberCount++
+			subscribed.Add(1)
+			go c.Run(subResCh, &array)
+		}
+	}
+	subscribed.Wait()
+
+	start := time.Now()
+	publisherCount := 0
+	for i, stream := range streams {
+		if len(stream) == 0 {
+			continue
+		}
+		c := &PublisherClient{
+			ID:           fmt.Sprintf("replay-%v", i),
+			ClientID:     fmt.Sprintf("publisher-replay-%v-%v", i, runStamp),
+			BrokerURL:    b.BrokerURL,
+			BrokerUser:   b.BrokerUser,
+			BrokerPass:   b.BrokerPass,
+			MsgCount:     len(stream),
+			Quiet:        b.Quiet,
+			WaitTimeout:  b.WaitTimeout,
+			TLSConfig:    b.TLSConfig,
+			RemoteUser:   b.RemoteUser,
+			RemotePwd:    b.RemotePwd,
+			Remote:       b.Remote,
+			CleanSession: true,
+			KeepAlive:    b.KeepAlive,
+			Verify:       b.Verify,
+			Inflight:     b.Inflight,
+			NoHeader:     b.NoHeader,
+			Replay:       stream,
+			ReplaySpeed:  b.Speed,
+			Integrity:    b.Integrity,
+		}
+		publisherCount++
+		go c.Run(resCh)
+	}
+
+	results := make([]*RunResults, publisherCount)
+	for i := range results {
+		results[i] = <-resCh
+	}
+	totalTime := time.Since(start)
+	subResults := make([]*SubscriberResults, subscriberCount)
+	for i := range subResults {
+		subResults[i] = <-subResCh
+	}
+	b.clear(retained)
+
+	latencies := []uint64{}
+	for _, arrayPointer := range latenciesPointers {
+		latencies = append(latencies, *arrayPointer...)
+	}
+	totals := calculateTotalResults(results, totalTime, publisherCount, latencies, subResults)
+	totals.Topics = len(distinct)
+	if b.Integrity != nil {
+		totals.Integrity = b.Integrity.Algorithm
+	}
+	for t := range distinct {
+		if depth := len(strings.Split(t, "/")); depth > totals.TopicDepth {
+			totals.TopicDepth = depth
+		}
+	}
+	var verifyResults *VerifyResults
+	if b.Verify {
+		verifyResults = calculateVerifyResults(b.MsgQoS, results, subResults, totals)
+	}
+	return &JSONResults{Runs: results, Subscribers: subResults, Verify: verifyResults, Totals: totals}
+}
+
+// clear removes the retained messages replayed by publishing an empty retained payload on their topics
+func (b *ReplayBenchmark) clear(topics map[string]struct{}) {
+	if len(topics) == 0 {
+		return
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(fmt.Sprintf("publisher-replay-clear-%v", time.Now().UTC().UnixMilli())).
+		SetCleanSession(true).
+		SetAutoReconnect(false)
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	opts.SetKeepAlive(0)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("Error clearing retained topics: %v\n", token.Error())
+		return
+	}
+	defer client.Disconnect(250)
+	tokens := make([]mqtt.Token, 0, len(topics))
+	for topic := range topics {
+		tokens = append(tokens, client.Publish(topic, 1, true, []byte{}))
+	}
+	deadline := time.Now().Add(b.WaitTimeout)
+	for _, token := range tokens {
+		token.WaitTimeout(time.Until(deadline))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eugenmayer/go-sshclient/sshwrapper"
+	"github.com/montanaflynn/stats"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// ResourceMonitor samples CPU and memory usage of the broker host while a benchmark runs.
+// The remote host is monitored over SSH, otherwise the local machine is sampled
+type ResourceMonitor struct {
+	sshApi *sshwrapper.SshApi
+	mu     sync.Mutex
+	cpu    []float64
+	ram    []float64
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newResourceMonitor(brokerURL string, remote bool, remoteUser string, remotePwd string) *ResourceMonitor {
+	m := &ResourceMonitor{}
+	if remote && remoteUser != "" {
+		host, _ := extractHostnameFromURL(brokerURL)
+		// the ssh-agent setup fails without agent, which does not matter: the password setup replaces it
+		sshApi, _ := sshwrapper.DefaultSshApiSetup(host, 22, remoteUser, "")
+		sshApi.Password = remotePwd
+		if err := sshApi.DefaultSshPasswordSetup(); err != nil {
+			log.Fatal(err)
+		}
+		m.sshApi = sshApi
+	}
+	return m
+}
+
+// Start samples the usage every interval until Stop is called
+func (m *ResourceMonitor) Start(interval time.Duration) {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	_, _ = cpu.Percent(0, false) // to initiate CPU usage measurements
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *ResourceMonitor) sample() {
+	cpuUsage := []float64{}
+	ramUsage := []float64{}
+	if m.sshApi != nil {
+		getRemoteCPUUsage(*m.sshApi, &cpuUsage)
+		getRemoteMemoryUsage(*m.sshApi, &ramUsage)
+	} else {
+		tmp, _ := cpu.Percent(0, false)
+		ram, _ := mem.VirtualMemory()
+		if len(tmp) > 0 {
+			cpuUsage = append(cpuUsage, tmp[0])
+		}
+		if ram != nil {
+			ramUsage = append(ramUsage, ram.UsedPercent)
+		}
+	}
+	m.mu.Lock()
+	m.cpu = append(m.cpu, cpuUsage...)
+	m.ram = append(m.ram, ramUsage...)
+	m.mu.Unlock()
+}
+
+// Stop ends the sampling and returns the average CPU and RAM usage in percent
+func (m *ResourceMonitor) Stop() (float64, float64) {
+	if m.stop != nil {
+		close(m.stop)
+		<-m.done
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cpuAvg, _ := stats.Mean(m.cpu)
+	ramAvg, _ := stats.Mean(m.ram)
+	if math.IsNaN(cpuAvg) {
+		cpuAvg = 0
+	}
+	if math.IsNaN(ramAvg) {
+		ramAvg = 0
+	}
+	return cpuAvg, ramAvg
+}
+
+// MemoryUsed returns the memory in use on the broker host in bytes
+func (m *ResourceMonitor) MemoryUsed() uint64 {
+	if m.sshApi != nil {
+		out, _, _ := m.sshApi.Run("free -b | awk '/Mem/ {print $3}'")
+		used, _ := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+		return used
+	}
+	ram, err := mem.VirtualMemory()
+	if err != nil {
+		return 0
+	}
+	return ram.Used
+}
+
+// Close releases the SSH connection, if any
+func (m *ResourceMonitor) Close() {
+	if m.sshApi != nil {
+		m.sshApi.Close()
+	}
+}
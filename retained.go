@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/montanaflynn/stats"
+)
+
+// RetainedBenchmark populates retained topics, then measures how long new wildcard subscribers take to receive them
+type RetainedBenchmark struct {
+	BrokerURL   string
+	BrokerUser  string
+	BrokerPass  string
+	TLSConfig   *tls.Config
+	Topics      []string
+	Filter      string // wildcard filter matching every topic
+	Updates     int    // number of values published on each topic, the last one must be retained
+	Subscribers int
+	MsgSize     int
+	MsgQoS      byte
+	Timeout     time.Duration
+	WaitTimeout time.Duration
+	Quiet       bool
+}
+
+// RetainedResults describes results of a retained message benchmark
+type RetainedResults struct {
+	Topics             int     `json:"topics"`
+	Updates            int     `json:"updates"`
+	PopulateTime       float64 `json:"populate_time"`
+	PopulateMsgsPerSec float64 `json:"populate_msgs_per_sec"`
+	Subscribers        int     `json:"subscribers"`
+	Complete           int     `json:"complete"`
+	FullSetTimeMin     float64 `json:"full_set_time_min"`
+	FullSetTimeMax     float64 `json:"full_set_time_max"`
+	FullSetTimeAvg     float64 `json:"full_set_time_mean_avg"`
+	AvgMsgsPerSec      float64 `json:"avg_msgs_per_sec"`
+	TotalMsgsPerSec    float64 `json:"total_msgs_per_sec"`
+	Missing            int64   `json:"missing"`
+	Stale              int64   `json:"stale"`
+	NotFlaggedRetained int64   `json:"not_flagged_retained"`
+	Foreign            int64   `json:"foreign"`
+}
+
+type retainedSubResults struct {
+	complete   bool
+	duration   time.Duration
+	received   int
+	missing    int
+	stale      int
+	notFlagged int
+	foreign    int // retained messages on topics matching the filter but not populated by the run
+}
+
+// Run populates the topics, runs the subscribers and clears the retained messages
+func (b *RetainedBenchmark) Run() *RetainedResults {
+	res := &RetainedResults{Topics: len(b.Topics), Updates: b.Updates, Subscribers: b.Subscribers}
+
+	// every topic is published Updates times in turn, so message seq carries the value (seq / topics) of its topic
+	pubResCh := make(chan *RunResults)
+	pub := &PublisherClient{
+		ID:          "retained",
+		ClientID:    fmt.Sprintf("publisher-retained-%v", time.Now().UTC().UnixMilli()),
+		BrokerURL:   b.BrokerURL,
+		BrokerUser:  b.BrokerUser,
+		BrokerPass:  b.BrokerPass,
+		MsgTopics:   b.Topics,
+		MsgSize:     b.MsgSize,
+		MsgCount:    len(b.Topics) * b.Updates,
+		MsgQoS:      b.MsgQoS,
+		Quiet:       b.Quiet,
+		WaitTimeout: b.WaitTimeout,
+		TLSConfig:   b.TLSConfig,
+		Retained:    true,
+		Disconnect:  true,
+	}
+	if !b.Quiet {
+		log.Printf("Populating %v retained topics\n", len(b.Topics))
+	}
+	started := time.Now()
+	go pub.Run(pubResCh)
+	pubRes := <-pubResCh
+	res.PopulateTime = time.Since(started).Seconds()
+	res.PopulateMsgsPerSec = float64(pubRes.Successes) / res.PopulateTime
+	if pubRes.ConnectError != "" {
+		log.Fatalf("Error populating retained topics: %v", pubRes.ConnectError)
+	}
+
+	latest := make(map[string]uint32, len(b.Topics))
+	for i, topic := range b.Topics {
+		latest[topic] = uint32((b.Updates-1)*len(b.Topics) + i)
+	}
+
+	var wg sync.WaitGroup
+	subResults := make([]*retainedSubResults, b.Subscribers)
+	for i := 0; i < b.Subscribers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			subResults[i] = b.subscribe(i, latest)
+		}(i)
+	}
+	wg.Wait()
+
+	durations := []float64{}
+	for _, sub := range subResults {
+		res.Missing += int64(sub.missing)
+		res.Stale += int64(sub.stale)
+		res.NotFlaggedRetained += int64(sub.notFlagged)
+		res.Foreign += int64(sub.foreign)
+		if sub.duration > 0 {
+			msgsPerSec := float64(sub.received) / sub.duration.Seconds()
+			res.TotalMsgsPerSec += msgsPerSec
+		}
+		if sub.complete {
+			res.Complete++
+			durations = append(durations, float64(sub.duration.Microseconds())/1000)
+		}
+	}
+	if b.Subscribers > 0 {
+		res.AvgMsgsPerSec = res.TotalMsgsPerSec / float64(b.Subscribers)
+	}
+	if len(durations) > 0 {
+		res.FullSetTimeMin, _ = stats.Min(durations)
+		res.FullSetTimeMax, _ = stats.Max(durations)
+		res.FullSetTimeAvg, _ = stats.Mean(durations)
+	}
+
+	b.clear()
+	return res
+}
+
+// subscribe connects a new subscriber and waits for the retained value of every topic
+func (b *RetainedBenchmark) subscribe(i int, latest map[string]uint32) *retainedSubResults {
+	res := &retainedSubResults{}
+	seen := make(map[string]uint32, len(b.Topics))
+	msgChan := make(chan mqtt.Message)
+	done := make(chan struct{})
+	defer close(done)
+
+	client := b.newClient(fmt.Sprintf("subscriber-retained-%v-%v", i, time.Now().UTC().UnixMilli()))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("SUBSCRIBER retained-%v had error connecting to the broker: %v\n", i, token.Error())
+		res.missing = len(b.Topics)
+		return res
+	}
+	defer client.Disconnect(250)
+
+	started := time.Now()
+	token := client.Subscribe(b.Filter, b.MsgQoS, func(c mqtt.Client, m mqtt.Message) {
+		select {
+		case msgChan <- m:
+		case <-done:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Printf("SUBSCRIBER retained-%v had error subscribing to %v: %v\n", i, b.Filter, token.Error())
+	}
+
+	timer := time.NewTimer(b.Timeout)
+	defer timer.Stop()
+	for len(seen) < len(b.Topics) {
+		select {
+		case m := <-msgChan:
+			if _, ok := latest[m.Topic()]; !ok {
+				res.foreign++
+				continue
+			}
+			res.received++
+			if !m.Retained() {
+				res.notFlagged++
+			}
+			if header, ok := readHeader(m.Payload()); ok {
+				seen[m.Topic()] = header.Seq
+			}
+		case <-timer.C:
+			if !b.Quiet {
+				log.Printf("SUBSCRIBER retained-%v only received %v of %v retained topics\n", i, len(seen), len(b.Topics))
+			}
+			res.duration = time.Since(started)
+			res.missing = len(b.Topics) - len(seen)
+			res.stale = countStale(seen, latest)
+			return res
+		}
+	}
+	res.duration = time.Since(started)
+	res.complete = true
+	res.stale = countStale(seen, latest)
+	return res
+}
+
+func countStale(seen map[string]uint32, latest map[string]uint32) int {
+	stale := 0
+	for topic, seq := range seen {
+		if expected, ok := latest[topic]; ok && seq != expected {
+			stale++
+		}
+	}
+	return stale
+}
+
+// clear removes the retained messages by publishing an empty retained payload on every topic
+func (b *RetainedBenchmark) clear() {
+	client := b.newClient(fmt.Sprintf("publisher-retained-clear-%v", time.Now().UTC().UnixMilli()))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("Error clearing retained topics: %v\n", token.Error())
+		return
+	}
+	defer client.Disconnect(250)
+	tokens := make([]mqtt.Token, 0, len(b.Topics))
+	for _, topic := range b.Topics {
+		tokens = append(tokens, client.Publish(topic, 1, true, []byte{}))
+	}
+	deadline := time.Now().Add(b.WaitTimeout)
+	for _, token := range tokens {
+		token.WaitTimeout(time.Until(deadline))
+	}
+}
+
+func (b *RetainedBenchmark) newClient(clientID string) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(clientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false)
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	opts.SetKeepAlive(0)
+	return mqtt.NewClient(opts)
+}
+
+// retainedFilter derives a wildcard filter matching every topic of the benchmark from their common leading levels
+func retainedFilter(topics []string) string {
+	prefix := strings.Split(topics[0], "/")
+	for _, topic := range topics[1:] {
+		levels := strings.Split(topic, "/")
+		n := 0
+		for n < len(prefix) && n < len(levels) && prefix[n] == levels[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if len(topics) == 1 {
+		return topics[0]
+	}
+	return strings.Join(append(prefix, "#"), "/")
+}
+
+func printRetainedResults(res *RetainedResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= RETAINED (%d topics) =========\n", res.Topics)
+		fmt.Printf("Populate time (sec):         %.3f\n", res.PopulateTime)
+		fmt.Printf("Populate rate (msg/sec):     %.3f\n", res.PopulateMsgsPerSec)
+		fmt.Printf("Complete subscribers:        %d/%d\n", res.Complete, res.Subscribers)
+		fmt.Printf("Full set time min (ms):      %.3f\n", res.FullSetTimeMin)
+		fmt.Printf("Full set time max (ms):      %.3f\n", res.FullSetTimeMax)
+		fmt.Printf("Full set time mean (ms):     %.3f\n", res.FullSetTimeAvg)
+		fmt.Printf("Average Bandwidth Per Subscriber (msg/sec): %.3f\n", res.AvgMsgsPerSec)
+		fmt.Printf("Total Bandwidth Subscribers (msg/sec):   %.3f\n", res.TotalMsgsPerSec)
+		fmt.Printf("Missing topics:              %d\n", res.Missing)
+		fmt.Printf("Stale values:                %d\n", res.Stale)
+		fmt.Printf("Not flagged retained:        %d\n", res.NotFlaggedRetained)
+		fmt.Printf("Foreign topics:              %d\n", res.Foreign)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/montanaflynn/stats"
+)
+
+// RPCBenchmark measures the round trip of requests answered by responder clients. MQTT 3.1.1 has no response topic
+// nor correlation data, so requests follow a reply-topic convention: the payload starts with the usual header, whose
+// publisher key and sequence number correlate the response, followed by the length (2 bytes) and the reply topic.
+// Responders echo the payload on the reply topic and the round trip is timed by the requester clock alone
+type RPCBenchmark struct {
+	BrokerURL  string
+	BrokerUser string
+	BrokerPass string
+	TLSConfig  *tls.Config
+	Topic      string
+	Requesters int
+	Responders int
+	Requests   int // requests sent by every requester
+	Inflight   int // outstanding requests per requester
+	Interval   time.Duration
+	MsgSize    int
+	MsgQoS     byte
+	Timeout    time.Duration // a request not answered in time counts as a timeout
+	Quiet      bool
+}
+
+// RPCResults describes results of a request/response benchmark
+type RPCResults struct {
+	Requesters     int     `json:"requesters"`
+	Responders     int     `json:"responders"`
+	Requests       int64   `json:"requests"`
+	Responses      int64   `json:"responses"`
+	Timeouts       int64   `json:"timeouts"`
+	Failures       int64   `json:"failures"`
+	RunTime        float64 `json:"run_time"`
+	RequestsPerSec float64 `json:"requests_per_sec"`
+	RTTMin         float64 `json:"rtt_min"`
+	RTTMax         float64 `json:"rtt_max"`
+	RTTAvg         float64 `json:"rtt_mean_avg"`
+	RTTStd         float64 `json:"rtt_mean_std"`
+	RTTP50         float64 `json:"rtt_p50"`
+	RTTP95         float64 `json:"rtt_p95"`
+	RTTP99         float64 `json:"rtt_p99"`
+}
+
+type requesterResults struct {
+	requests  int64
+	responses int64
+	timeouts  int64
+	failures  int64
+	rtts      []float64
+}
+
+func (b *RPCBenchmark) requestTopic(responder int) string {
+	return fmt.Sprintf("%v/rpc/%v/request", b.Topic, responder)
+}
+
+func (b *RPCBenchmark) replyTopic(requester int) string {
+	return fmt.Sprintf("%v/rpc/reply/%v", b.Topic, requester)
+}
+
+// Run starts the responders, then the requesters, each sending its requests to the responders in turn
+func (b *RPCBenchmark) Run() *RPCResults {
+	res := &RPCResults{Requesters: b.Requesters, Responders: b.Responders}
+	runStamp := time.Now().UTC().UnixMilli()
+
+	responders := []mqtt.Client{}
+	for r := 0; r < b.Responders; r++ {
+		responders = append(responders, b.respond(r, runStamp))
+	}
+	defer func() {
+		for _, client := range responders {
+			client.Disconnect(250)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	reqResults := make([]*requesterResults, b.Requesters)
+	started := time.Now()
+	for i := 0; i < b.Requesters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reqResults[i] = b.request(i, runStamp)
+		}(i)
+	}
+	wg.Wait()
+	res.RunTime = time.Since(started).Seconds()
+
+	rtts := []float64{}
+	for _, r := range reqResults {
+		res.Requests += r.requests
+		res.Responses += r.responses
+		res.Timeouts += r.timeouts
+		res.Failures += r.failures
+		rtts = append(rtts, r.rtts...)
+	}
+	res.RequestsPerSec = float64(res.Responses) / res.RunTime
+	if len(rtts) > 0 {
+		res.RTTMin, _ = stats.Min(rtts)
+		res.RTTMax, _ = stats.Max(rtts)
+		res.RTTAvg, _ = stats.Mean(rtts)
+		res.RTTP50, _ = stats.Percentile(rtts, 50)
+		res.RTTP95, _ = stats.Percentile(rtts, 95)
+		res.RTTP99, _ = stats.Percentile(rtts, 99)
+	}
+	if len(rtts) > 1 {
+		res.RTTStd, _ = stats.StandardDeviationSample(rtts)
+	}
+	return res
+}
+
+// respond connects a responder echoing every request on its reply topic
+func (b *RPCBenchmark) respond(r int, runStamp int64) mqtt.Client {
+	client := b.newClient(fmt.Sprintf("responder-%v-%v", r, runStamp))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("RESPONDER %v had error connecting to the broker: %v", r, token.Error())
+	}
+	token := client.Subscribe(b.requestTopic(r), b.MsgQoS, func(c mqtt.Client, m mqtt.Message) {
+		payload := m.Payload()
+		if len(payload) < headerLen+2 {
+			return
+		}
+		n := int(binary.LittleEndian.Uint16(payload[headerLen : headerLen+2]))
+		if len(payload) < headerLen+2+n {
+			return
+		}
+		c.Publish(string(payload[headerLen+2:headerLen+2+n]), b.MsgQoS, false, payload)
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Fatalf("RESPONDER %v had error subscribing to %v: %v", r, b.requestTopic(r), token.Error())
+	}
+	if !b.Quiet {
+		log.Printf("RESPONDER %v is answering %v\n", r, b.requestTopic(r))
+	}
+	return client
+}
+
+// request sends the requests of a requester with at most Inflight of them waiting for their response
+func (b *RPCBenchmark) request(i int, runStamp int64) *requesterResults {
+	res := &requesterResults{}
+	clientID := fmt.Sprintf("requester-%v-%v", i, runStamp)
+	key := publisherKey(clientID)
+	replyTopic := b.replyTopic(i)
+
+	var mu sync.Mutex
+	pending := map[uint32]time.Time{}
+	window := make(chan struct{}, b.Inflight)
+	var outstanding sync.WaitGroup
+	// complete removes a request once answered or timed out, it reports false when it was already completed
+	complete := func(seq uint32) (time.Time, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent, ok := pending[seq]
+		if !ok {
+			return sent, false
+		}
+		delete(pending, seq)
+		<-window
+		outstanding.Done()
+		return sent, true
+	}
+
+	client := b.newClient(clientID)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("REQUESTER %v had error connecting to the broker: %v\n", i, token.Error())
+		res.requests = int64(b.Requests)
+		res.failures = int64(b.Requests)
+		return res
+	}
+	defer client.Disconnect(250)
+	token := client.Subscribe(replyTopic, b.MsgQoS, func(c mqtt.Client, m mqtt.Message) {
+		header, ok := readHeader(m.Payload())
+		if !ok || header.Publisher != key {
+			return
+		}
+		if sent, ok := complete(header.Seq); ok {
+			mu.Lock()
+			res.responses++
+			res.rtts = append(res.rtts, float64(time.Since(sent).Microseconds())/1000)
+			mu.Unlock()
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		log.Printf("REQUESTER %v had error subscribing to %v: %v\n", i, replyTopic, token.Error())
+		res.requests = int64(b.Requests)
+		res.failures = int64(b.Requests)
+		return res
+	}
+
+	size := headerLen + 2 + len(replyTopic)
+	if b.MsgSize > size {
+		size = b.MsgSize
+	}
+	for seq := 0; seq < b.Requests; seq++ {
+		window <- struct{}{}
+		payload := make([]byte, size)
+		binary.LittleEndian.PutUint16(payload[headerLen:headerLen+2], uint16(len(replyTopic)))
+		copy(payload[headerLen+2:], replyTopic)
+
+		mu.Lock()
+		sent := time.Now()
+		pending[uint32(seq)] = sent
+		outstanding.Add(1)
+		mu.Unlock()
+		writeHeader(payload, sent, key, uint32(seq))
+		client.Publish(b.requestTopic((i+seq)%b.Responders), b.MsgQoS, false, payload)
+		res.requests++
+		timedOut := uint32(seq)
+		time.AfterFunc(b.Timeout, func() {
+			if _, ok := complete(timedOut); ok {
+				mu.Lock()
+				res.timeouts++
+				mu.Unlock()
+			}
+		})
+
+		if !b.Quiet && seq > 0 && seq%1000 == 0 {
+			log.Printf("REQUESTER %v sent %v requests and keeps requesting...\n", i, seq)
+		}
+		time.Sleep(b.Interval)
+	}
+	outstanding.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return res
+}
+
+func (b *RPCBenchmark) newClient(clientID string) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(clientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false)
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	opts.SetKeepAlive(0)
+	return mqtt.NewClient(opts)
+}
+
+func printRPCResults(res *RPCResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= RPC (%d requesters, %d responders) =========\n", res.Requesters, res.Responders)
+		fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(res.Responses)/float64(res.Requests), res.Responses, res.Requests)
+		fmt.Printf("Timeouts:                    %d\n", res.Timeouts)
+		fmt.Printf("Failures:                    %d\n", res.Failures)
+		fmt.Printf("Runtime (sec):               %.3f\n", res.RunTime)
+		fmt.Printf("Request rate (req/sec):      %.3f\n", res.RequestsPerSec)
+		fmt.Printf("RTT min (ms):                %.3f\n", res.RTTMin)
+		fmt.Printf("RTT max (ms):                %.3f\n", res.RTTMax)
+		fmt.Printf("RTT mean (ms):               %.3f\n", res.RTTAvg)
+		fmt.Printf("RTT std (ms):                %.3f\n", res.RTTStd)
+		fmt.Printf("RTT p50 (ms):                %.3f\n", res.RTTP50)
+		fmt.Printf("RTT p95 (ms):                %.3f\n", res.RTTP95)
+		fmt.Printf("RTT p99 (ms):                %.3f\n", res.RTTP99)
+	}
+}
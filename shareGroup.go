@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/montanaflynn/stats"
+)
+
+// ShareGroup tracks the messages received by the members of a shared subscription,
+// the broker delivers every message to a single member so completion is decided for the whole group
+type ShareGroup struct {
+	Filter   string
+	Expected int64
+
+	received int64 // every message delivered to a member, damaged ones included
+	done     chan struct{}
+	once     sync.Once
+}
+
+// ShareGroupResults describes how the broker distributed the messages of a topic across the group members
+type ShareGroupResults struct {
+	Filter          string  `json:"filter"`
+	Members         int     `json:"members"`
+	Expected        int64   `json:"expected"`
+	Received        int64   `json:"received"`
+	MinPerMember    int64   `json:"min_per_member"`
+	MaxPerMember    int64   `json:"max_per_member"`
+	StdPerMember    float64 `json:"std_per_member"`
+	Fairness        float64 `json:"fairness"`
+	TotalMsgsPerSec float64 `json:"total_msgs_per_sec"`
+}
+
+func newShareGroup(group string, topic string, expected int) *ShareGroup {
+	return &ShareGroup{
+		Filter:   "$share/" + group + "/" + topic,
+		Expected: int64(expected),
+		done:     make(chan struct{}),
+	}
+}
+
+func (g *ShareGroup) add() {
+	if atomic.AddInt64(&g.received, 1) >= g.Expected {
+		g.once.Do(func() { close(g.done) })
+	}
+}
+
+// Done is closed once the group received every expected message
+func (g *ShareGroup) Done() <-chan struct{} {
+	return g.done
+}
+
+func (g *ShareGroup) lost() int64 {
+	lost := g.Expected - atomic.LoadInt64(&g.received)
+	if lost < 0 {
+		return 0
+	}
+	return lost
+}
+
+// calculateShareGroupResults summarizes the distribution of the group messages, the fairness is Jain's index:
+// 1 when every member received the same number of messages, 1/members when a single member received them all
+func calculateShareGroupResults(g *ShareGroup, subResults []*SubscriberResults) *ShareGroupResults {
+	res := &ShareGroupResults{Filter: g.Filter, Expected: g.Expected}
+	counts := []float64{}
+	sumSquares := 0.0
+	for _, sub := range subResults {
+		if sub.Group != g.Filter {
+			continue
+		}
+		res.Members++
+		res.Received += sub.Received
+		res.TotalMsgsPerSec += sub.MsgsPerSec
+		counts = append(counts, float64(sub.Received))
+		sumSquares += float64(sub.Received) * float64(sub.Received)
+	}
+	if len(counts) == 0 {
+		return res
+	}
+	min, _ := stats.Min(counts)
+	max, _ := stats.Max(counts)
+	res.MinPerMember = int64(min)
+	res.MaxPerMember = int64(max)
+	res.StdPerMember, _ = stats.StandardDeviationPopulation(counts)
+	if sumSquares > 0 {
+		res.Fairness = float64(res.Received) * float64(res.Received) / (float64(len(counts)) * sumSquares)
+	}
+	if math.IsNaN(res.TotalMsgsPerSec) {
+		res.TotalMsgsPerSec = 0
+	}
+	return res
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SizeDistribution draws the payload size of every message. Distributions are written as:
+//
+//	fixed:1024                   always 1024 bytes
+//	uniform:100-2000             uniformly from 100 to 2000 bytes
+//	normal:1000,200              normally with a mean of 1000 and a standard deviation of 200 bytes
+//	lognormal:1000,2000          log-normally with a mean of 1000 and a standard deviation of 2000 bytes
+//	buckets:100:70,1000:25,1e5:5 100 bytes 70% of the time, 1000 bytes 25% and 100000 bytes 5%
+//	csv:sizes.csv                weighted sizes read from <size>,<weight> lines, e.g. a histogram from production
+//
+// Sizes are never smaller than the header nor larger than the maximum MQTT payload
+type SizeDistribution struct {
+	Spec string
+
+	kind    string
+	a, b    float64
+	sizes   []int
+	weights []float64 // cumulative weights of sizes
+}
+
+// maxPayloadSize is the largest payload of an MQTT packet, whose remaining length is at most 268435455 bytes
+const maxPayloadSize = 268435455
+
+func parseSizeDistribution(spec string) (*SizeDistribution, error) {
+	d := &SizeDistribution{Spec: spec}
+	kind, params, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid size distribution %q, expected <kind>:<parameters>", spec)
+	}
+	d.kind = kind
+	var err error
+	switch kind {
+	case "fixed":
+		if d.a, err = strconv.ParseFloat(params, 64); err == nil && !finite(d.a) {
+			err = fmt.Errorf("the size should be finite")
+		}
+	case "uniform":
+		from, to, ok := strings.Cut(params, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid size distribution %q, expected uniform:<min>-<max>", spec)
+		}
+		if d.a, err = strconv.ParseFloat(from, 64); err == nil {
+			d.b, err = strconv.ParseFloat(to, 64)
+		}
+		if err == nil && (!finite(d.a) || !finite(d.b)) {
+			err = fmt.Errorf("the bounds should be finite")
+		}
+		if err == nil && d.b < d.a {
+			err = fmt.Errorf("empty range")
+		}
+	case "normal", "lognormal":
+		mean, std, ok := strings.Cut(params, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid size distribution %q, expected %v:<mean>,<std>", spec, kind)
+		}
+		if d.a, err = strconv.ParseFloat(mean, 64); err == nil {
+			d.b, err = strconv.ParseFloat(std, 64)
+		}
+		if err == nil && (d.b < 0 || !finite(d.a) || !finite(d.b)) {
+			err = fmt.Errorf("the mean should be finite and the standard deviation finite and >= 0")
+		}
+		if err == nil && kind == "lognormal" {
+			if d.a <= 0 {
+				return nil, fmt.Errorf("invalid size distribution %q, the mean should be > 0", spec)
+			}
+			// parameters of the underlying normal distribution giving this mean and standard deviation
+			sigma2 := math.Log(1 + d.b*d.b/(d.a*d.a))
+			d.a, d.b = math.Log(d.a)-sigma2/2, math.Sqrt(sigma2)
+		}
+	case "buckets":
+		for _, bucket := range strings.Split(params, ",") {
+			size, weight, ok := strings.Cut(strings.TrimSpace(bucket), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid size bucket %q, expected <size>:<weight>", bucket)
+			}
+			if err = d.addBucket(size, weight); err != nil {
+				break
+			}
+		}
+	case "csv":
+		err = d.readCSV(params)
+	default:
+		return nil, fmt.Errorf("unknown size distribution %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid size distribution %q: %v", spec, err)
+	}
+	if (kind == "buckets" || kind == "csv") && (len(d.sizes) == 0 || d.weights[len(d.weights)-1] <= 0) {
+		return nil, fmt.Errorf("invalid size distribution %q: no weighted size", spec)
+	}
+	return d, nil
+}
+
+func (d *SizeDistribution) addBucket(size string, weight string) error {
+	s, err := strconv.ParseFloat(strings.TrimSpace(size), 64)
+	if err != nil {
+		return err
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+	if err != nil {
+		return err
+	}
+	if !finite(s) || !finite(w) || s < 0 || w < 0 {
+		return fmt.Errorf("negative or infinite size or weight")
+	}
+	if s > maxPayloadSize {
+		return fmt.Errorf("size larger than the maximum MQTT payload of %v bytes", maxPayloadSize)
+	}
+	total := w
+	if len(d.weights) > 0 {
+		total += d.weights[len(d.weights)-1]
+	}
+	d.sizes = append(d.sizes, int(s))
+	d.weights = append(d.weights, total)
+	return nil
+}
+
+// readCSV reads <size>,<weight> lines, a first line that does not parse is taken as a header
+func (d *SizeDistribution) readCSV(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		if len(record) < 2 {
+			return fmt.Errorf("line %v: expected <size>,<weight>", i+1)
+		}
+		if err := d.addBucket(record[0], record[1]); err != nil {
+			if i == 0 {
+				continue
+			}
+			return fmt.Errorf("line %v: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Draw returns the size of a message
+func (d *SizeDistribution) Draw(random *rand.Rand) int {
+	var size float64
+	switch d.kind {
+	case "fixed":
+		size = d.a
+	case "uniform":
+		size = d.a + random.Float64()*(d.b-d.a+1)
+	case "normal":
+		size = d.a + random.NormFloat64()*d.b
+	case "lognormal":
+		size = math.Exp(d.a + random.NormFloat64()*d.b)
+	case "buckets", "csv":
+		w := random.Float64() * d.weights[len(d.weights)-1]
+		size = float64(d.sizes[sort.SearchFloat64s(d.weights, w)])
+	}
+	// NaN fails both comparisons and gets the header size
+	if size > maxPayloadSize {
+		return maxPayloadSize
+	}
+	if !(size >= headerLen) {
+		return headerLen
+	}
+	return int(size)
+}
+
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// parseSizeDistributions parses a semicolon separated list of distributions, assigned to the publishers in turn
+func parseSizeDistributions(value string) ([]*SizeDistribution, error) {
+	dists := []*SizeDistribution{}
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		d, err := parseSizeDistribution(spec)
+		if err != nil {
+			return nil, err
+		}
+		dists = append(dists, d)
+	}
+	return dists, nil
+}
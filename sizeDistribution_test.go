@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestSizeDistributionDraw(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		min, max int
+		mean     float64
+	}{
+		{"fixed:1024", 1024, 1024, 1024},
+		{"uniform:100-199", 100, 199, 149.5},
+		{"normal:1000,100", 500, 1500, 1000},
+		{"lognormal:1000,200", 300, 3000, 1000},
+		{"buckets:100:3,1000:1", 100, 1000, 325},
+		{"buckets: 100 : 1 , 200 : 0 ", 100, 100, 100},
+		// clamped to the header and the largest MQTT payload
+		{"fixed:1", headerLen, headerLen, headerLen},
+		{"fixed:-5", headerLen, headerLen, headerLen},
+		{"fixed:1e12", maxPayloadSize, maxPayloadSize, maxPayloadSize},
+		{"normal:0,0", headerLen, headerLen, headerLen},
+	} {
+		d, err := parseSizeDistribution(tc.spec)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.spec, err)
+		}
+		random := rand.New(rand.NewSource(1))
+		sum := 0.0
+		const draws = 10000
+		for i := 0; i < draws; i++ {
+			size := d.Draw(random)
+			if size < tc.min || size > tc.max {
+				t.Fatalf("%v: drew %v, expected between %v and %v", tc.spec, size, tc.min, tc.max)
+			}
+			sum += float64(size)
+		}
+		if mean := sum / draws; math.Abs(mean-tc.mean) > tc.mean*0.05 {
+			t.Errorf("%v: mean %v, expected %v", tc.spec, mean, tc.mean)
+		}
+	}
+}
+
+func TestSizeDistributionCSV(t *testing.T) {
+	dir := t.TempDir()
+	d, err := parseSizeDistribution("csv:" + writeFile(t, dir, "sizes.csv", "size,weight\n100,1\n200,1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.sizes) != 2 || d.sizes[1] != 200 || d.weights[1] != 2 {
+		t.Errorf("read sizes %v and cumulative weights %v", d.sizes, d.weights)
+	}
+	for _, content := range []string{
+		"",
+		"size,weight\n",
+		"100,1\n200\n",
+		"100,1\n200,x\n",
+		"100,1\n-200,1\n",
+		"100,1\n\"200,1\n",
+	} {
+		path := writeFile(t, dir, "invalid.csv", content)
+		if _, err := parseSizeDistribution("csv:" + path); err == nil {
+			t.Errorf("%q parsed", content)
+		}
+	}
+	if _, err := parseSizeDistribution("csv:" + filepath.Join(dir, "missing.csv")); err == nil {
+		t.Errorf("missing csv file parsed")
+	}
+}
+
+func TestSizeDistributionInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"1024",
+		"constant:1024",
+		"fixed:x",
+		"fixed:Inf",
+		"fixed:NaN",
+		"uniform:100",
+		"uniform:200-100",
+		"uniform:100-Inf",
+		"normal:1000",
+		"normal:1000,-1",
+		"normal:NaN,1",
+		"lognormal:0,10",
+		"lognormal:1000,Inf",
+		"buckets:100",
+		"buckets:100:x",
+		"buckets:-100:1",
+		"buckets:100:-1",
+		"buckets:100:Inf",
+		"buckets:1e9:1",
+		"buckets:100:0",
+	} {
+		if _, err := parseSizeDistribution(spec); err == nil {
+			t.Errorf("%v parsed", spec)
+		}
+	}
+}
+
+func TestParseSizeDistributions(t *testing.T) {
+	dists, err := parseSizeDistributions(" fixed:100 ; ;uniform:1-2;")
+	if err != nil || len(dists) != 2 || dists[0].Spec != "fixed:100" || dists[1].Spec != "uniform:1-2" {
+		t.Errorf("parsed %v, %v", dists, err)
+	}
+	if _, err := parseSizeDistributions("fixed:100;fixed:x"); err == nil {
+		t.Errorf("invalid distribution of the list parsed")
+	}
+}
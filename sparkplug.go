@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/montanaflynn/stats"
+)
+
+const sparkplugNamespace = "spBv1.0"
+
+// SparkplugBenchmark simulates Sparkplug B edge nodes: every node registers its NDEATH as will, publishes its NBIRTH,
+// the DBIRTH of its devices, rounds of DDATA, then its NDEATH. Host applications subscribe to the group and validate
+// the sequence numbers, the birth/death semantics and the metric aliases of the stream
+type SparkplugBenchmark struct {
+	BrokerURL  string
+	BrokerUser string
+	BrokerPass string
+	TLSConfig  *tls.Config
+	Group      string
+	EdgeNodes  int
+	Devices    int // devices per edge node
+	Metrics    int // metrics per device
+	Messages   int // DDATA messages per device
+	Interval   time.Duration
+	Hosts      int
+	Timeout    time.Duration // time to wait for the hosts after the last NDEATH
+	Quiet      bool
+}
+
+// SparkplugResults describes results of a Sparkplug B benchmark
+type SparkplugResults struct {
+	EdgeNodes       int     `json:"edge_nodes"`
+	Devices         int     `json:"devices"`
+	Hosts           int     `json:"hosts"`
+	NBirths         int64   `json:"nbirths"`
+	DBirths         int64   `json:"dbirths"`
+	DData           int64   `json:"ddata"`
+	NDeaths         int64   `json:"ndeaths"`
+	PublishFailures int64   `json:"publish_failures"`
+	RunTime         float64 `json:"run_time"`
+	MsgsPerSec      float64 `json:"msgs_per_sec"`
+	Expected        int64   `json:"expected"`
+	Received        int64   `json:"received"`
+	Missing         int64   `json:"missing"`
+	SeqErrors       int64   `json:"seq_errors"`
+	BeforeBirth     int64   `json:"before_birth"`
+	AfterDeath      int64   `json:"after_death"`
+	BdSeqMismatches int64   `json:"bdseq_mismatches"`
+	UnknownAliases  int64   `json:"unknown_aliases"`
+	DecodeErrors    int64   `json:"decode_errors"`
+	MsgTimeMin      float64 `json:"msg_time_min"`
+	MsgTimeMax      float64 `json:"msg_time_max"`
+	MsgTimeAvg      float64 `json:"msg_time_mean_avg"`
+	MsgTimeP50      float64 `json:"msg_time_p50"`
+	MsgTimeP99      float64 `json:"msg_time_p99"`
+	Passed          bool    `json:"passed"`
+}
+
+type edgeNodeResults struct {
+	nbirths, dbirths, ddata, ndeaths int64
+	failures                         int64
+}
+
+// sparkplugNode is the state of an edge node as seen by a host application
+type sparkplugNode struct {
+	born    bool
+	dead    bool
+	bdSeq   uint64
+	nextSeq uint64
+	devices map[string]int // metrics announced by the DBIRTH of every device
+}
+
+// sparkplugHost validates the stream received by a host application
+type sparkplugHost struct {
+	mu              sync.Mutex
+	nodes           map[string]*sparkplugNode
+	received        int64
+	seqErrors       int64
+	beforeBirth     int64
+	afterDeath      int64
+	bdSeqMismatches int64
+	unknownAliases  int64
+	decodeErrors    int64
+	latencies       []float64
+}
+
+func (b *SparkplugBenchmark) topic(msgType string, node string, device string) string {
+	topic := fmt.Sprintf("%v/%v/%v/%v", sparkplugNamespace, b.Group, msgType, node)
+	if device != "" {
+		topic += "/" + device
+	}
+	return topic
+}
+
+// expected returns the number of messages every host should receive
+func (b *SparkplugBenchmark) expected() int64 {
+	return int64(b.EdgeNodes * (2 + b.Devices + b.Devices*b.Messages))
+}
+
+// Run starts the host applications, then the edge nodes
+func (b *SparkplugBenchmark) Run() *SparkplugResults {
+	res := &SparkplugResults{EdgeNodes: b.EdgeNodes, Devices: b.EdgeNodes * b.Devices, Hosts: b.Hosts}
+	runStamp := time.Now().UTC().UnixMilli()
+
+	hosts := make([]*sparkplugHost, b.Hosts)
+	for h := range hosts {
+		hosts[h] = &sparkplugHost{nodes: map[string]*sparkplugNode{}}
+		client := b.newClient(fmt.Sprintf("sparkplug-host-%v-%v", h, runStamp))
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			log.Fatalf("HOST %v had error connecting to the broker: %v", h, token.Error())
+		}
+		defer client.Disconnect(250)
+		host := hosts[h]
+		filter := fmt.Sprintf("%v/%v/#", sparkplugNamespace, b.Group)
+		token := client.Subscribe(filter, 1, func(c mqtt.Client, m mqtt.Message) {
+			host.receive(m.Topic(), m.Payload())
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Fatalf("HOST %v had error subscribing to %v: %v", h, filter, token.Error())
+		}
+	}
+
+	var wg sync.WaitGroup
+	nodeResults := make([]*edgeNodeResults, b.EdgeNodes)
+	started := time.Now()
+	for n := 0; n < b.EdgeNodes; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			nodeResults[n] = b.edgeNode(n, runStamp)
+		}(n)
+	}
+	wg.Wait()
+	res.RunTime = time.Since(started).Seconds()
+
+	// wait for the hosts to receive the whole stream
+	res.Expected = b.expected() * int64(b.Hosts)
+	deadline := time.Now().Add(b.Timeout)
+	for time.Now().Before(deadline) {
+		received := int64(0)
+		for _, host := range hosts {
+			host.mu.Lock()
+			received += host.received
+			host.mu.Unlock()
+		}
+		if received >= res.Expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, r := range nodeResults {
+		res.NBirths += r.nbirths
+		res.DBirths += r.dbirths
+		res.DData += r.ddata
+		res.NDeaths += r.ndeaths
+		res.PublishFailures += r.failures
+	}
+	published := res.NBirths + res.DBirths + res.DData + res.NDeaths
+	res.MsgsPerSec = float64(published) / res.RunTime
+
+	latencies := []float64{}
+	for _, host := range hosts {
+		host.mu.Lock()
+		res.Received += host.received
+		res.SeqErrors += host.seqErrors
+		res.BeforeBirth += host.beforeBirth
+		res.AfterDeath += host.afterDeath
+		res.BdSeqMismatches += host.bdSeqMismatches
+		res.UnknownAliases += host.unknownAliases
+		res.DecodeErrors += host.decodeErrors
+		latencies = append(latencies, host.latencies...)
+		host.mu.Unlock()
+	}
+	res.Missing = res.Expected - res.Received
+	if res.Missing < 0 {
+		res.Missing = 0
+	}
+	if len(latencies) > 0 {
+		res.MsgTimeMin, _ = stats.Min(latencies)
+		res.MsgTimeMax, _ = stats.Max(latencies)
+		res.MsgTimeAvg, _ = stats.Mean(latencies)
+		res.MsgTimeP50, _ = stats.Percentile(latencies, 50)
+		res.MsgTimeP99, _ = stats.Percentile(latencies, 99)
+	}
+	res.Passed = res.PublishFailures == 0 && res.Missing == 0 && res.SeqErrors == 0 && res.BeforeBirth == 0 &&
+		res.AfterDeath == 0 && res.BdSeqMismatches == 0 && res.UnknownAliases == 0 && res.DecodeErrors == 0
+	return res
+}
+
+// edgeNode runs the session of an edge node, from its NBIRTH to its NDEATH
+func (b *SparkplugBenchmark) edgeNode(n int, runStamp int64) *edgeNodeResults {
+	res := &edgeNodeResults{}
+	node := fmt.Sprintf("node-%v", n)
+	random := rand.New(rand.NewSource(int64(n)))
+	bdSeq := uint64(0)
+	seq := uint64(0)
+	// every message of the session but NDEATH carries the next sequence number, wrapping at 256
+	payload := func(metrics []sparkplugMetric) []byte {
+		p := &sparkplugPayload{Timestamp: uint64(time.Now().UTC().UnixMilli()), Metrics: metrics, Seq: seq, HasSeq: true}
+		seq = (seq + 1) % 256
+		return p.marshal()
+	}
+	death := func() []byte {
+		p := &sparkplugPayload{
+			Timestamp: uint64(time.Now().UTC().UnixMilli()),
+			Metrics:   []sparkplugMetric{{Name: "bdSeq", Datatype: sparkplugUInt64, Long: bdSeq}},
+		}
+		return p.marshal()
+	}
+
+	opts := b.options(fmt.Sprintf("sparkplug-edge-%v-%v", n, runStamp))
+	opts.SetBinaryWill(b.topic("NDEATH", node, ""), death(), 1, false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("EDGE NODE %v had error connecting to the broker: %v\n", node, token.Error())
+		res.failures = int64(2 + b.Devices + b.Devices*b.Messages)
+		return res
+	}
+	publish := func(topic string, qos byte, payload []byte, count *int64) {
+		if token := client.Publish(topic, qos, false, payload); token.Wait() && token.Error() != nil {
+			log.Printf("EDGE NODE %v had error publishing on %v: %v\n", node, topic, token.Error())
+			res.failures++
+			return
+		}
+		*count++
+	}
+
+	publish(b.topic("NBIRTH", node, ""), 0, payload([]sparkplugMetric{
+		{Name: "bdSeq", Datatype: sparkplugUInt64, Long: bdSeq},
+		{Name: "Node Control/Rebirth", Datatype: sparkplugBoolean},
+	}), &res.nbirths)
+	for d := 0; d < b.Devices; d++ {
+		metrics := make([]sparkplugMetric, b.Metrics)
+		for m := range metrics {
+			metrics[m] = sparkplugMetric{
+				Name:     fmt.Sprintf("sensor/%v", m),
+				Alias:    uint64(m + 1),
+				Datatype: sparkplugDouble,
+				Double:   random.Float64() * 100,
+			}
+		}
+		publish(b.topic("DBIRTH", node, fmt.Sprintf("device-%v", d)), 0, payload(metrics), &res.dbirths)
+	}
+	for i := 0; i < b.Messages; i++ {
+		for d := 0; d < b.Devices; d++ {
+			// report by alias only, as announced by the DBIRTH
+			metrics := make([]sparkplugMetric, b.Metrics)
+			for m := range metrics {
+				metrics[m] = sparkplugMetric{Alias: uint64(m + 1), Datatype: sparkplugDouble, Double: random.Float64() * 100}
+			}
+			publish(b.topic("DDATA", node, fmt.Sprintf("device-%v", d)), 0, payload(metrics), &res.ddata)
+		}
+		if !b.Quiet && i > 0 && i%100 == 0 {
+			log.Printf("EDGE NODE %v published %v rounds of DDATA and keeps publishing...\n", node, i)
+		}
+		time.Sleep(b.Interval)
+	}
+	// a node disconnecting gracefully publishes its NDEATH itself, the broker does not send the will
+	publish(b.topic("NDEATH", node, ""), 1, death(), &res.ndeaths)
+	client.Disconnect(250)
+	if !b.Quiet {
+		log.Printf("EDGE NODE %v is done\n", node)
+	}
+	return res
+}
+
+// receive validates a message against the state of its edge node
+func (h *sparkplugHost) receive(topic string, payload []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.received++
+	// spBv1.0/<group>/<type>/<node>[/<device>]
+	parts := strings.Split(topic, "/")
+	p, err := unmarshalSparkplugPayload(payload)
+	if err != nil || len(parts) < 4 {
+		h.decodeErrors++
+		return
+	}
+	if p.Timestamp > 0 {
+		h.latencies = append(h.latencies, float64(time.Now().UTC().UnixMilli()-int64(p.Timestamp)))
+	}
+	msgType, nodeID := parts[2], parts[3]
+	device := ""
+	if len(parts) > 4 {
+		device = parts[4]
+	}
+	node, ok := h.nodes[nodeID]
+	if !ok {
+		node = &sparkplugNode{devices: map[string]int{}}
+		h.nodes[nodeID] = node
+	}
+	bdSeq := func() (uint64, bool) {
+		for _, m := range p.Metrics {
+			if m.Name == "bdSeq" {
+				return m.Long, true
+			}
+		}
+		return 0, false
+	}
+
+	switch msgType {
+	case "NBIRTH":
+		node.born, node.dead = true, false
+		node.devices = map[string]int{}
+		node.bdSeq, _ = bdSeq()
+		if !p.HasSeq || p.Seq != 0 {
+			h.seqErrors++
+		}
+		node.nextSeq = 1
+	case "NDEATH":
+		if !node.born {
+			h.beforeBirth++
+		}
+		if seq, ok := bdSeq(); !ok || seq != node.bdSeq {
+			h.bdSeqMismatches++
+		}
+		node.dead = true
+	case "DBIRTH", "DDATA":
+		if !node.born {
+			h.beforeBirth++
+		} else if node.dead {
+			h.afterDeath++
+		}
+		if !p.HasSeq || p.Seq != node.nextSeq {
+			h.seqErrors++
+		}
+		// resynchronize on the received number so that a gap counts once
+		node.nextSeq = (p.Seq + 1) % 256
+		if msgType == "DBIRTH" {
+			node.devices[device] = len(p.Metrics)
+			return
+		}
+		metrics, ok := node.devices[device]
+		if !ok {
+			// before the birth of its node, the message is already counted
+			if node.born {
+				h.beforeBirth++
+			}
+			return
+		}
+		for _, m := range p.Metrics {
+			if m.Alias == 0 || m.Alias > uint64(metrics) {
+				h.unknownAliases++
+			}
+		}
+	default:
+		h.decodeErrors++
+	}
+}
+
+func (b *SparkplugBenchmark) options(clientID string) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.BrokerURL).
+		SetClientID(clientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false)
+	if b.BrokerUser != "" && b.BrokerPass != "" {
+		opts.SetUsername(b.BrokerUser)
+		opts.SetPassword(b.BrokerPass)
+	}
+	if b.TLSConfig != nil {
+		opts.SetTLSConfig(b.TLSConfig)
+	}
+	opts.SetKeepAlive(0)
+	return opts
+}
+
+func (b *SparkplugBenchmark) newClient(clientID string) mqtt.Client {
+	return mqtt.NewClient(b.options(clientID))
+}
+
+func printSparkplugResults(res *SparkplugResults, format string) {
+	switch format {
+	case "json":
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("Error marshalling results: %v", err)
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, data, "", "\t")
+
+		fmt.Println(out.String())
+	default:
+		fmt.Printf("========= SPARKPLUG B (%d edge nodes, %d devices, %d hosts) =========\n", res.EdgeNodes, res.Devices, res.Hosts)
+		fmt.Printf("Published:                   %d NBIRTH, %d DBIRTH, %d DDATA, %d NDEATH\n", res.NBirths, res.DBirths, res.DData, res.NDeaths)
+		fmt.Printf("Publish failures:            %d\n", res.PublishFailures)
+		fmt.Printf("Runtime (sec):               %.3f\n", res.RunTime)
+		fmt.Printf("Publish rate (msg/sec):      %.3f\n", res.MsgsPerSec)
+		fmt.Printf("Ratio:                       %.3f (%d/%d)\n", float64(res.Received)/float64(res.Expected), res.Received, res.Expected)
+		fmt.Printf("Missing:                     %d\n", res.Missing)
+		fmt.Printf("Sequence errors:             %d\n", res.SeqErrors)
+		fmt.Printf("Messages before birth:       %d\n", res.BeforeBirth)
+		fmt.Printf("Messages after death:        %d\n", res.AfterDeath)
+		fmt.Printf("bdSeq mismatches:            %d\n", res.BdSeqMismatches)
+		fmt.Printf("Unknown aliases:             %d\n", res.UnknownAliases)
+		fmt.Printf("Decode errors:               %d\n", res.DecodeErrors)
+		fmt.Printf("Msg time min (ms):           %.3f\n", res.MsgTimeMin)
+		fmt.Printf("Msg time max (ms):           %.3f\n", res.MsgTimeMax)
+		fmt.Printf("Msg time mean (ms):          %.3f\n", res.MsgTimeAvg)
+		fmt.Printf("Msg time p50 (ms):           %.3f\n", res.MsgTimeP50)
+		fmt.Printf("Msg time p99 (ms):           %.3f\n", res.MsgTimeP99)
+		if res.Passed {
+			fmt.Printf("Validation:                  PASSED\n")
+		} else {
+			fmt.Printf("Validation:                  FAILED\n")
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Sparkplug B payloads are protobuf messages (sparkplug_b.proto). Only the fields used by the workload are encoded:
+//
+//	Payload: timestamp = 1 (uint64), metrics = 2 (Metric), seq = 3 (uint64)
+//	Metric:  name = 1 (string), alias = 2 (uint64), timestamp = 3 (uint64), datatype = 4 (uint32),
+//	         long_value = 11 (uint64), double_value = 13 (double), boolean_value = 14 (bool)
+//
+// and unknown fields are skipped when decoding
+const (
+	sparkplugUInt64  = 8
+	sparkplugDouble  = 10
+	sparkplugBoolean = 11
+)
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+type sparkplugMetric struct {
+	Name     string
+	Alias    uint64
+	Datatype uint32
+	Long     uint64
+	Double   float64
+	Boolean  bool
+}
+
+type sparkplugPayload struct {
+	Timestamp uint64
+	Metrics   []sparkplugMetric
+	Seq       uint64
+	HasSeq    bool // NDEATH payloads carry no sequence number
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendProtoTag(b, field, protoWireVarint), v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(appendProtoTag(b, field, protoWireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func (m *sparkplugMetric) marshal() []byte {
+	b := []byte{}
+	if m.Name != "" {
+		b = appendProtoBytes(b, 1, []byte(m.Name))
+	}
+	if m.Alias != 0 {
+		b = appendProtoVarint(b, 2, m.Alias)
+	}
+	b = appendProtoVarint(b, 4, uint64(m.Datatype))
+	switch m.Datatype {
+	case sparkplugUInt64:
+		b = appendProtoVarint(b, 11, m.Long)
+	case sparkplugDouble:
+		b = binary.LittleEndian.AppendUint64(appendProtoTag(b, 13, protoWireFixed64), math.Float64bits(m.Double))
+	case sparkplugBoolean:
+		v := uint64(0)
+		if m.Boolean {
+			v = 1
+		}
+		b = appendProtoVarint(b, 14, v)
+	}
+	return b
+}
+
+func (p *sparkplugPayload) marshal() []byte {
+	b := appendProtoVarint(nil, 1, p.Timestamp)
+	for i := range p.Metrics {
+		b = appendProtoBytes(b, 2, p.Metrics[i].marshal())
+	}
+	if p.HasSeq {
+		b = appendProtoVarint(b, 3, p.Seq)
+	}
+	return b
+}
+
+// protoFields calls field for every field of a protobuf message, with the value of varint and fixed fields and the
+// content of length delimited ones
+func protoFields(b []byte, field func(num int, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf tag")
+		}
+		b = b[n:]
+		num, wireType := int(tag>>3), int(tag&7)
+		var v uint64
+		var data []byte
+		switch wireType {
+		case protoWireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("invalid protobuf varint of field %v", num)
+			}
+			b = b[n:]
+		case protoWireFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("truncated protobuf field %v", num)
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoWireFixed32:
+			if len(b) < 4 {
+				return fmt.Errorf("truncated protobuf field %v", num)
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoWireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("truncated protobuf field %v", num)
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %v of field %v", wireType, num)
+		}
+		if err := field(num, wireType, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unmarshalSparkplugPayload(b []byte) (*sparkplugPayload, error) {
+	p := &sparkplugPayload{}
+	err := protoFields(b, func(num int, wireType int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			p.Timestamp = v
+		case 2:
+			m := sparkplugMetric{}
+			err := protoFields(data, func(num int, wireType int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					m.Name = string(data)
+				case 2:
+					m.Alias = v
+				case 4:
+					m.Datatype = uint32(v)
+				case 11:
+					m.Long = v
+				case 13:
+					m.Double = math.Float64frombits(v)
+				case 14:
+					m.Boolean = v != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case 3:
+			p.Seq = v
+			p.HasSeq = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// samplePayload holds every encoded metric type, names, aliases and a sequence number
+func samplePayload() *sparkplugPayload {
+	return &sparkplugPayload{
+		Timestamp: 1700000000123,
+		Metrics: []sparkplugMetric{
+			{Name: "bdSeq", Datatype: sparkplugUInt64, Long: math.MaxUint64},
+			{Name: "temperature", Alias: 1, Datatype: sparkplugDouble, Double: -21.5},
+			{Alias: 300, Datatype: sparkplugBoolean, Boolean: true},
+			{Alias: 2, Datatype: sparkplugBoolean},
+		},
+		Seq:    255,
+		HasSeq: true,
+	}
+}
+
+func TestSparkplugPayloadRoundTrip(t *testing.T) {
+	for _, p := range []*sparkplugPayload{
+		samplePayload(),
+		// NDEATH payloads carry no sequence number
+		{Metrics: []sparkplugMetric{{Name: "bdSeq", Datatype: sparkplugUInt64, Long: 3}}},
+		{Seq: 0, HasSeq: true},
+	} {
+		decoded, err := unmarshalSparkplugPayload(p.marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, p) {
+			t.Errorf("decoded %+v, expected %+v", decoded, p)
+		}
+	}
+}
+
+func TestSparkplugPayloadUnknownFields(t *testing.T) {
+	// fields of sparkplug_b.proto the workload does not use, of every wire type
+	metric := appendProtoVarint(nil, 2, 7)
+	metric = binary.LittleEndian.AppendUint32(appendProtoTag(metric, 10, protoWireFixed32), 1)
+	metric = appendProtoBytes(metric, 15, []byte("text"))
+	b := appendProtoBytes(nil, 2, metric)
+	b = appendProtoBytes(b, 5, []byte("uuid"))
+	b = binary.LittleEndian.AppendUint64(appendProtoTag(b, 6, protoWireFixed64), 1)
+	b = appendProtoVarint(b, 3, 9)
+
+	p, err := unmarshalSparkplugPayload(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &sparkplugPayload{Metrics: []sparkplugMetric{{Alias: 7}}, Seq: 9, HasSeq: true}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("decoded %+v, expected %+v", p, expected)
+	}
+}
+
+func TestSparkplugPayloadMalformed(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"truncated tag":       {0x80},
+		"truncated varint":    {0x08, 0x80},
+		"truncated fixed64":   {0x09, 0, 0, 0},
+		"truncated fixed32":   {0x0d, 0, 0},
+		"truncated length":    {0x12, 0x80},
+		"length past the end": {0x12, 0x05, 0x08},
+		"huge length":         {0x12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"group wire type":     {0x0b},
+		"invalid metric":      appendProtoBytes(nil, 2, []byte{0x08}),
+	} {
+		if _, err := unmarshalSparkplugPayload(b); err == nil {
+			t.Errorf("%v decoded", name)
+		}
+	}
+
+	// a payload cut inside a metric fails, between two fields it decodes what precedes the cut
+	b := samplePayload().marshal()
+	for i := 0; i < len(b); i++ {
+		p, err := unmarshalSparkplugPayload(b[:i])
+		if err == nil && len(p.Metrics) == len(samplePayload().Metrics) && p.HasSeq {
+			t.Errorf("payload truncated to %v bytes decoded entirely", i)
+		}
+	}
+	// mutations must fail or decode, never panic
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		mutated := append([]byte{}, b...)
+		mutated[random.Intn(len(mutated))] = byte(random.Intn(256))
+		unmarshalSparkplugPayload(mutated)
+	}
+}
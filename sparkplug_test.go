@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestSparkplugHost(t *testing.T) {
+	b := &SparkplugBenchmark{Group: "bench"}
+	message := func(h *sparkplugHost, msgType string, node string, device string, p *sparkplugPayload) {
+		h.receive(b.topic(msgType, node, device), p.marshal())
+	}
+	bdSeq := func(seq uint64) *sparkplugPayload {
+		return &sparkplugPayload{Metrics: []sparkplugMetric{{Name: "bdSeq", Datatype: sparkplugUInt64, Long: seq}}}
+	}
+	data := func(seq uint64, alias uint64) *sparkplugPayload {
+		return &sparkplugPayload{Seq: seq, HasSeq: true, Metrics: []sparkplugMetric{{Alias: alias, Datatype: sparkplugBoolean}}}
+	}
+
+	// a valid session
+	h := &sparkplugHost{nodes: map[string]*sparkplugNode{}}
+	birth := bdSeq(4)
+	birth.HasSeq = true
+	message(h, "NBIRTH", "node-0", "", birth)
+	message(h, "DBIRTH", "node-0", "device-0", data(1, 1))
+	message(h, "DDATA", "node-0", "device-0", data(2, 1))
+	message(h, "NDEATH", "node-0", "", bdSeq(4))
+	if h.received != 4 || h.seqErrors+h.beforeBirth+h.afterDeath+h.bdSeqMismatches+h.unknownAliases+h.decodeErrors != 0 {
+		t.Errorf("valid session counted %+v", h)
+	}
+
+	// DDATA of an unknown device of an unborn node counts once
+	h = &sparkplugHost{nodes: map[string]*sparkplugNode{}}
+	message(h, "DDATA", "node-0", "device-0", data(0, 1))
+	if h.beforeBirth != 1 {
+		t.Errorf("DDATA before the node birth counted %v times", h.beforeBirth)
+	}
+
+	// invalid sessions
+	h = &sparkplugHost{nodes: map[string]*sparkplugNode{}}
+	message(h, "NBIRTH", "node-0", "", birth)
+	message(h, "DDATA", "node-0", "device-0", data(1, 1))
+	message(h, "DBIRTH", "node-0", "device-0", data(3, 1))
+	message(h, "DDATA", "node-0", "device-0", data(4, 2))
+	message(h, "NDEATH", "node-0", "", bdSeq(5))
+	message(h, "DDATA", "node-0", "device-0", data(5, 1))
+	h.receive("spBv1.0/bench/NBIRTH", birth.marshal())
+	h.receive(b.topic("NBIRTH", "node-1", ""), []byte{0x80})
+	h.receive(b.topic("STATE", "node-0", ""), birth.marshal())
+	counts := [7]int64{h.received, h.beforeBirth, h.seqErrors, h.unknownAliases, h.bdSeqMismatches, h.afterDeath, h.decodeErrors}
+	// received, before birth, sequence errors, unknown aliases, bdSeq mismatches, after death, decode errors
+	if expected := [7]int64{9, 1, 1, 1, 1, 1, 3}; counts != expected {
+		t.Errorf("invalid sessions counted %v, expected %v", counts, expected)
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	// "context"
 	"crypto/tls"
-	"encoding/binary"
 	"log"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -22,67 +22,68 @@ type SubscriberClient struct {
 	TLSConfig     *tls.Config
 	Quiet         bool
 	Timeout       int
+	CleanSession  bool
+	Conn          *ConnTracker
+	KeepAlive     time.Duration
+	Group         *ShareGroup     // shared subscription the subscriber is a member of, if any
+	Ready         *sync.WaitGroup // marked done once the first subscription completed or failed
+	NoHeader      bool            // payloads carry no header, messages can be neither timed nor deduplicated
+	Decoder       PayloadEncoding // decodes every message, its latency metadata replacing the header
+	Integrity     *Integrity      // verifies the length and checksum of every payload
+
+	reconnects reconnectStats
+	readyOnce  sync.Once
 }
 
-func (c *SubscriberClient) Run(res chan float64, latencies *[]uint64) {
+func (c *SubscriberClient) Run(res chan *SubscriberResults, latencies *[]uint64) {
 	c.consume(res, latencies)
 }
 
-func (c *SubscriberClient) consume(res chan float64, latencies *[]uint64) {
+func (c *SubscriberClient) ready() {
+	if c.Ready != nil {
+		c.readyOnce.Do(c.Ready.Done)
+	}
+}
+
+func (c *SubscriberClient) consume(res chan *SubscriberResults, latencies *[]uint64) {
+	msgChan := make(chan mqtt.Message)
+	done := make(chan struct{})
+	onMessage := func(client mqtt.Client, m mqtt.Message) {
+		select {
+		case msgChan <- m:
+		case <-done:
+		}
+	}
+
+	filter := c.MsgTopic
+	var groupDone <-chan struct{}
+	if c.Group != nil {
+		filter = c.Group.Filter
+		groupDone = c.Group.Done()
+	}
+
 	onConnected := func(client mqtt.Client) {
 		if !c.Quiet {
 			log.Printf("SUBSCRIBER %v is connected to the broker %v\n", c.ID, c.BrokerURL)
 		}
-		startTime := time.Now()
-		ctr := 0
-		timeout := time.Second * time.Duration(c.Timeout)
-		msgChan := make(chan mqtt.Message)
-
-		client.Subscribe(c.MsgTopic, c.MsgQoS, func(c mqtt.Client, m mqtt.Message) {
-			timestamp := time.Now().UTC().UnixMilli()
-			receivedTimestampBytes := m.Payload()[:8]
-			receivedTimestamp := binary.LittleEndian.Uint64(receivedTimestampBytes)
-			*latencies = append(*latencies, uint64(timestamp)-receivedTimestamp)
-			msgChan <- m
-		})
-
-		timer := time.NewTimer(timeout)
-
-		for {
-			select {
-			case <-msgChan:
-				if !timer.Stop() {
-					<-timer.C
-				}
-				timer.Reset(timeout)
-				ctr++
-				if float64(ctr) >= float64(c.TopicMsgCount) {
-					duration := time.Since(startTime)
-					res <- float64(ctr) / duration.Seconds()
-					if !c.Quiet {
-						log.Printf("SUBSCRIBER %v received every message, disconnecting", c.ID)
-					}
-					return
-				}
-			case <-timer.C:
-				duration := time.Since(startTime).Seconds() - timeout.Seconds()
-				res <- float64(ctr) / duration
-				// res <- 0
-				if !c.Quiet {
-					log.Printf("SUBSCRIBER %v only received %v messages, can't calculate throughput", c.ID, ctr)
-				}
-				return
-			}
+		c.reconnects.connected()
+		// subscribe again on every connection, a clean session loses its subscriptions with the connection
+		token := client.Subscribe(filter, c.MsgQoS, onMessage)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("SUBSCRIBER %v had error subscribing to %v: %v\n", c.ID, filter, token.Error())
 		}
+		c.ready()
 	}
 
 	opts := mqtt.NewClientOptions().
 		AddBroker(c.BrokerURL).
 		SetClientID(c.ClientID).
-		SetCleanSession(true).
+		SetCleanSession(c.CleanSession).
 		SetAutoReconnect(true).
 		SetOnConnectHandler(onConnected).
 		SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+			c.reconnects.lost()
 			log.Printf("SUBSCRIBER %v lost connection to the broker: %v. Will reconnect...\n", c.ClientID, reason.Error())
 		})
 	if c.BrokerUser != "" && c.BrokerPass != "" {
@@ -92,12 +93,121 @@ func (c *SubscriberClient) consume(res chan float64, latencies *[]uint64) {
 	if c.TLSConfig != nil {
 		opts.SetTLSConfig(c.TLSConfig)
 	}
-	opts.SetKeepAlive(0)
+	if c.Conn != nil {
+		opts.SetCustomOpenConnectionFn(c.Conn.openConnection)
+	}
+	opts.SetKeepAlive(c.KeepAlive)
 	client := mqtt.NewClient(opts)
 	token := client.Connect()
 	token.Wait()
 
 	if token.Error() != nil {
 		log.Printf("SUBSCRIBER %v had error connecting to the broker: %v\n", c.ClientID, token.Error())
+		c.ready()
+	}
+
+	results := &SubscriberResults{ID: c.ID, Topic: c.MsgTopic}
+	if c.Group != nil {
+		results.Group = c.Group.Filter
+	}
+	seen := make(map[uint64]struct{})
+	startTime := time.Now()
+	timeout := time.Second * time.Duration(c.Timeout)
+	timer := time.NewTimer(timeout)
+
+	var decodeTime time.Duration
+	finish := func(duration float64) {
+		close(done)
+		if c.Decoder != nil && results.Received > 0 {
+			results.DecodeTimeAvg = float64(decodeTime.Microseconds()) / 1000 / float64(results.Received)
+		}
+		results.MsgsPerSec = float64(results.Received) / duration
+		results.MBPerSec = float64(results.Bytes) / duration / 1e6
+		results.WireMBPerSec = float64(results.WireBytes) / duration / 1e6
+		// the messages lost by a shared subscription are only known for the whole group
+		if c.Group == nil {
+			results.Lost = int64(c.TopicMsgCount) - results.Received - results.failures()
+			if results.Lost < 0 {
+				results.Lost = 0
+			}
+		}
+		results.ReconnectTimes = c.reconnects.snapshot()
+		results.Reconnects = int64(len(results.ReconnectTimes))
+		client.Disconnect(250)
+		res <- results
+	}
+
+	for {
+		select {
+		case m := <-msgChan:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+
+			results.Bytes += int64(len(m.Payload()))
+			results.WireBytes += publishWireSize(m.Topic(), m.Qos(), len(m.Payload()))
+			payload := m.Payload()
+			intact := true
+			if c.Integrity != nil {
+				var err error
+				if payload, err = c.Integrity.Open(payload); err == errTruncated {
+					results.Truncated++
+				} else if err != nil {
+					results.Corrupted++
+				}
+				intact = err == nil
+			}
+			header, ok := readHeader(payload)
+			if c.Decoder != nil && intact {
+				started := time.Now()
+				var err error
+				header, err = decodeMessage(c.Decoder, payload)
+				decodeTime += time.Since(started)
+				if ok = err == nil; !ok {
+					results.DecodeErrors++
+					intact = false
+				}
+			}
+			// the metadata of a damaged or undecodable message cannot be trusted, it is only counted as a failure
+			if intact {
+				if ok && !c.NoHeader {
+					// redeliveries after a reconnect are counted once
+					if _, dup := seen[header.key()]; dup {
+						results.Duplicates++
+						continue
+					}
+					seen[header.key()] = struct{}{}
+					timestamp := time.Now().UTC().UnixMilli()
+					*latencies = append(*latencies, uint64(timestamp)-header.Sent)
+				}
+				results.Received++
+			}
+			if c.Group != nil {
+				c.Group.add()
+			}
+
+			if results.Received+results.failures() >= int64(c.TopicMsgCount) {
+				finish(time.Since(startTime).Seconds())
+				if !c.Quiet {
+					log.Printf("SUBSCRIBER %v received every message, disconnecting", c.ID)
+				}
+				return
+			}
+		case <-groupDone:
+			finish(time.Since(startTime).Seconds())
+			if !c.Quiet {
+				log.Printf("SUBSCRIBER %v group received every message, disconnecting", c.ID)
+			}
+			return
+		case <-timer.C:
+			duration := time.Since(startTime).Seconds() - timeout.Seconds()
+			finish(duration)
+			// res <- 0
+			if !c.Quiet {
+				log.Printf("SUBSCRIBER %v only received %v messages, can't calculate throughput", c.ID, results.Received)
+			}
+			return
+		}
 	}
 }
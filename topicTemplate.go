@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// TopicTemplate generates a topic tree from a template such as site/{1..10}/device/{1..100}/sensor/{temp|hum}.
+// Placeholders between braces are:
+//
+//	{a..b}          every integer from a to b
+//	{x|y|z}         every listed value
+//	{rand:a..b}     a random integer from a to b, drawn for each topic
+//	{rand:x|y|z}    a random value of the list, drawn for each topic
+//	{n}             the topic number, which makes every topic unique
+//	{client}        the number of the publisher on the topic, subscribers use the + wildcard; a whole level
+//
+// Ranges and lists are enumerated: the template describes the product of their values. Ranges are not materialized,
+// a value is computed from its index
+type TopicTemplate struct {
+	Template string
+	parts    []templatePart
+}
+
+type templatePart struct {
+	literal string
+	values  []string // listed values
+	from    int      // first integer of a range of count integers
+	count   int
+	random  bool
+	number  bool
+	client  bool
+}
+
+// size returns the number of values of a range or list, 0 for other parts
+func (p *templatePart) size() int {
+	if p.values != nil {
+		return len(p.values)
+	}
+	return p.count
+}
+
+func (p *templatePart) value(i int) string {
+	if p.values != nil {
+		return p.values[i]
+	}
+	return strconv.Itoa(p.from + i)
+}
+
+// clientPlaceholder is left in the generated topics, see clientTopic
+const clientPlaceholder = "{client}"
+
+// clientTopic replaces the {client} placeholder of a generated topic, with the publisher number or the + wildcard
+func clientTopic(topic string, client string) string {
+	return strings.ReplaceAll(topic, clientPlaceholder, client)
+}
+
+func parseTopicTemplate(template string) (*TopicTemplate, error) {
+	t := &TopicTemplate{Template: template}
+	rest := template
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			open = len(rest)
+		}
+		if strings.ContainsAny(rest[:open], "+#") {
+			return nil, fmt.Errorf("topic template %q should not contain wildcards", template)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		if open == len(rest) {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in topic template %q", template)
+		}
+		part, err := parsePlaceholder(rest[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[open+end+1:]
+	}
+	for _, level := range strings.Split(template, "/") {
+		if level != clientPlaceholder && strings.Contains(level, clientPlaceholder) {
+			return nil, fmt.Errorf("%v should be a whole level of topic template %q", clientPlaceholder, template)
+		}
+	}
+	return t, nil
+}
+
+func parsePlaceholder(placeholder string) (templatePart, error) {
+	part := templatePart{}
+	if placeholder == "n" {
+		part.number = true
+		return part, nil
+	}
+	if placeholder == "client" {
+		part.client = true
+		return part, nil
+	}
+	if strings.HasPrefix(placeholder, "rand:") {
+		part.random = true
+		placeholder = strings.TrimPrefix(placeholder, "rand:")
+	}
+	if bounds := strings.SplitN(placeholder, "..", 2); len(bounds) == 2 {
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return part, fmt.Errorf("invalid range {%v}: %v", placeholder, err)
+		}
+		to, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return part, fmt.Errorf("invalid range {%v}: %v", placeholder, err)
+		}
+		if to < from {
+			return part, fmt.Errorf("invalid range {%v}: empty", placeholder)
+		}
+		if part.count = to - from + 1; part.count <= 0 {
+			return part, fmt.Errorf("invalid range {%v}: too large", placeholder)
+		}
+		part.from = from
+		return part, nil
+	}
+	part.values = strings.Split(placeholder, "|")
+	for _, v := range part.values {
+		if v == "" || strings.ContainsAny(v, "/+#") {
+			return part, fmt.Errorf("invalid value %q in {%v}", v, placeholder)
+		}
+	}
+	return part, nil
+}
+
+// Cardinality returns the number of distinct topics the ranges and lists of the template describe
+func (t *TopicTemplate) Cardinality() int {
+	const maxCardinality = 1 << 40
+	n := 1
+	for _, p := range t.parts {
+		if size := p.size(); size > 0 && !p.random {
+			// checked before multiplying, which could overflow
+			if n > maxCardinality/size {
+				return maxCardinality
+			}
+			n *= size
+		}
+	}
+	return n
+}
+
+// Depth returns the number of levels of the generated topics
+func (t *TopicTemplate) Depth() int {
+	depth := 1
+	for _, p := range t.parts {
+		depth += strings.Count(p.literal, "/")
+	}
+	return depth
+}
+
+// HasClient reports whether the topics hold the {client} placeholder
+func (t *TopicTemplate) HasClient() bool {
+	for _, p := range t.parts {
+		if p.client {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TopicTemplate) hasNumber() bool {
+	for _, p := range t.parts {
+		if p.number {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns count distinct topics. When the template describes more topics than requested, the topics are
+// picked evenly across the whole tree rather than filling its first branches
+func (t *TopicTemplate) Expand(count int) ([]string, error) {
+	cardinality := t.Cardinality()
+	if count > cardinality && !t.hasNumber() {
+		return nil, fmt.Errorf("topic template %q only describes %v distinct topics, %v requested", t.Template, cardinality, count)
+	}
+	random := rand.New(rand.NewSource(1))
+	topics := make([]string, count)
+	for n := 0; n < count; n++ {
+		combination := n
+		if count <= cardinality {
+			combination = spread(n, count, cardinality)
+		}
+		topics[n] = t.render(n, combination, random)
+	}
+	return topics, nil
+}
+
+// spread returns the combination of the n-th of count topics picked evenly among cardinality, n * cardinality / count
+// computed on 128 bits as the product overflows 64 bits for large trees
+func spread(n int, count int, cardinality int) int {
+	hi, lo := bits.Mul64(uint64(n), uint64(cardinality))
+	// n < count keeps the quotient below cardinality, so it fits
+	q, _ := bits.Div64(hi, lo, uint64(count))
+	return int(q)
+}
+
+// render builds the topic of the given number, the combination is decoded with the last range varying the fastest
+func (t *TopicTemplate) render(n int, combination int, random *rand.Rand) string {
+	values := make([]string, len(t.parts))
+	for i := len(t.parts) - 1; i >= 0; i-- {
+		p := &t.parts[i]
+		switch {
+		case p.number:
+			values[i] = strconv.Itoa(n)
+		case p.client:
+			values[i] = clientPlaceholder
+		case p.random:
+			values[i] = p.value(random.Intn(p.size()))
+		case p.size() > 0:
+			values[i] = p.value(combination % p.size())
+			combination /= p.size()
+		default:
+			values[i] = p.literal
+		}
+	}
+	return strings.Join(values, "")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopicTemplateExpand(t *testing.T) {
+	for _, tc := range []struct {
+		template    string
+		count       int
+		cardinality int
+		depth       int
+		expected    []string
+	}{
+		{"a/{1..2}/{x|y}", 4, 4, 3, []string{"a/1/x", "a/1/y", "a/2/x", "a/2/y"}},
+		// picked evenly across the tree rather than in its first branch
+		{"a/{1..4}/{x|y}", 4, 8, 3, []string{"a/1/x", "a/2/x", "a/3/x", "a/4/x"}},
+		{"dev-{n}/t", 3, 1, 2, []string{"dev-0/t", "dev-1/t", "dev-2/t"}},
+		{"s/{-1..1}/{client}", 3, 3, 3, []string{"s/-1/{client}", "s/0/{client}", "s/1/{client}"}},
+		{"plain", 1, 1, 1, []string{"plain"}},
+	} {
+		tmpl, err := parseTopicTemplate(tc.template)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.template, err)
+		}
+		if c := tmpl.Cardinality(); c != tc.cardinality {
+			t.Errorf("%v: cardinality %v, expected %v", tc.template, c, tc.cardinality)
+		}
+		if d := tmpl.Depth(); d != tc.depth {
+			t.Errorf("%v: depth %v, expected %v", tc.template, d, tc.depth)
+		}
+		topics, err := tmpl.Expand(tc.count)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.template, err)
+		}
+		if !reflect.DeepEqual(topics, tc.expected) {
+			t.Errorf("%v: expanded %v, expected %v", tc.template, topics, tc.expected)
+		}
+	}
+}
+
+func TestTopicTemplateRandom(t *testing.T) {
+	tmpl, err := parseTopicTemplate("a/{1..3}/{rand:5..6}/{rand:x|y}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := tmpl.Cardinality(); c != 3 {
+		t.Errorf("random values add distinct topics: cardinality %v", c)
+	}
+	topics, _ := tmpl.Expand(3)
+	for i, topic := range topics {
+		levels := strings.Split(topic, "/")
+		if levels[1] != []string{"1", "2", "3"}[i] || (levels[2] != "5" && levels[2] != "6") || (levels[3] != "x" && levels[3] != "y") {
+			t.Errorf("unexpected topic %v", topic)
+		}
+	}
+}
+
+func TestTopicTemplateLarge(t *testing.T) {
+	// ranges are not materialized and the cardinality is capped instead of overflowing
+	tmpl, err := parseTopicTemplate("{1..1000000000}/{1..1000000000}/{1..1000000000}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := tmpl.Cardinality(); c != 1<<40 {
+		t.Errorf("cardinality %v, expected the 2^40 cap", c)
+	}
+	topics, err := tmpl.Expand(2)
+	if err != nil || !reflect.DeepEqual(topics, []string{"1/1/1", "1/550/755813889"}) {
+		t.Errorf("expanded %v, %v", topics, err)
+	}
+	// count * cardinality overflows 64 bits
+	if n := spread(1<<30-1, 1<<30, 1<<40); n != 1<<40-1<<10 {
+		t.Errorf("spread %v, expected %v", n, 1<<40-1<<10)
+	}
+}
+
+func TestTopicTemplateInvalid(t *testing.T) {
+	for _, template := range []string{
+		"a/{1..2",
+		"a/{2..1}",
+		"a/{1..x}",
+		"a/{x||y}",
+		"a/{x|+}",
+		"a/{x/y}",
+		"a/+/{1..2}",
+		"a/{1..2}/#",
+		"a/dev-{client}",
+		"a/{-9223372036854775808..9223372036854775807}",
+	} {
+		if _, err := parseTopicTemplate(template); err == nil {
+			t.Errorf("%v parsed", template)
+		}
+	}
+	tmpl, _ := parseTopicTemplate("a/{1..2}")
+	if _, err := tmpl.Expand(3); err == nil {
+		t.Errorf("expanded more topics than the template describes")
+	}
+}
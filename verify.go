@@ -0,0 +1,44 @@
+package main
+
+// VerifyResults checks the delivery guarantee of the QoS level end to end: every message must be acknowledged to the
+// publisher, then received at least once (QoS 1), exactly once (QoS 2) or at most once (QoS 0) by every subscriber.
+// A corrupted, truncated or undecodable message fails the verification whatever the QoS
+type VerifyResults struct {
+	QoS         byte   `json:"qos"`
+	Guarantee   string `json:"guarantee"`
+	Acked       int64  `json:"acked"`
+	AckTimeouts int64  `json:"ack_timeouts"`
+	AckErrors   int64  `json:"ack_errors"`
+	Received    int64  `json:"received"`
+	Lost        int64  `json:"lost"`
+	Duplicated  int64  `json:"duplicated"`
+	Damaged     int64  `json:"damaged"`
+	Passed      bool   `json:"passed"`
+}
+
+func calculateVerifyResults(qos byte, results []*RunResults, subResults []*SubscriberResults, totals *TotalResults) *VerifyResults {
+	res := &VerifyResults{QoS: qos, Lost: totals.MsgsLost, Duplicated: totals.MsgsDuplicated}
+	res.Damaged = totals.SubscriberFailures
+	for _, r := range results {
+		res.Acked += r.Successes
+		res.AckTimeouts += r.AckTimeouts
+		res.AckErrors += r.Failures - r.AckTimeouts
+	}
+	for _, sub := range subResults {
+		res.Received += sub.Received
+	}
+	acked := res.AckTimeouts == 0 && res.AckErrors == 0
+	switch qos {
+	case 0:
+		res.Guarantee = "at most once"
+		res.Passed = acked && res.Duplicated == 0
+	case 1:
+		res.Guarantee = "at least once"
+		res.Passed = acked && res.Lost == 0
+	default:
+		res.Guarantee = "exactly once"
+		res.Passed = acked && res.Lost == 0 && res.Duplicated == 0
+	}
+	res.Passed = res.Passed && res.Damaged == 0
+	return res
+}